@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func newAuditEvent(si *Interaction, action string, teamID int) *AuditEvent {
+	actorName := si.User.Name
+	if actorName == "" {
+		actorName = si.User.Username
+	}
+	event := &AuditEvent{
+		ActorID:   si.User.ID,
+		ActorName: actorName,
+		Action:    action,
+		TeamID:    teamID,
+	}
+	if si.submission != nil {
+		event.Reason = si.submission.reason
+		event.Note = si.submission.note
+	}
+	return event
+}
+
+// For actions Sibyl takes on its own
+func newSystemAuditEvent(action string, teamID int) *AuditEvent {
+	return &AuditEvent{
+		ActorName: "Sibyl",
+		Action:    action,
+		TeamID:    teamID,
+	}
+}
+
+func snapshotCloses(rec *TeamRecord) map[int]*int {
+	closes := make(map[int]*int)
+	for userID, user := range rec.Users {
+		closes[userID] = user.CloseID
+	}
+	return closes
+}
+
+// Records the users whose lock state changed since the snapshot, along with the closes involved
+func (event *AuditEvent) setCloseChanges(before map[int]*int, rec *TeamRecord) {
+	users := make([]*TeamRecordUser, 0)
+	closeIDs := make([]string, 0)
+	for userID, user := range rec.Users {
+		prev := before[userID]
+		switch {
+		case prev == nil && user.CloseID != nil:
+			closeIDs = append(closeIDs, strconv.Itoa(*user.CloseID))
+		case prev != nil && user.CloseID == nil:
+			closeIDs = append(closeIDs, strconv.Itoa(*prev))
+		default:
+			continue
+		}
+		users = append(users, user)
+	}
+	event.setAffectedUsers(users)
+	sort.Strings(closeIDs)
+	event.CloseIDs = strings.Join(closeIDs, ",")
+}
+
+func (event *AuditEvent) setAffectedUsers(users []*TeamRecordUser) {
+	logins := make([]string, len(users))
+	for i, user := range users {
+		logins[i] = user.Login
+		if logins[i] == "" {
+			logins[i] = strconv.Itoa(user.UserID)
+		}
+	}
+	sort.Strings(logins)
+	event.AffectedUsers = strings.Join(logins, ",")
+}
+
+func (event *AuditEvent) finish(result string, err error) {
+	event.Result = result
+	if err != nil {
+		event.Error = err.Error()
+	}
+	if err := event.create(); err != nil {
+		outputErr(err, false)
+	}
+}
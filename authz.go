@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type groupCache struct {
+	sync.Mutex
+	members map[string]map[string]bool
+	fetched map[string]time.Time
+}
+
+// User group membership rarely changes, so avoid asking Slack on every click
+const groupCacheTimeout = 5 * time.Minute
+
+var errActionDenied = errors.New("actor is not authorized for this action")
+
+var userGroups = &groupCache{
+	members: make(map[string]map[string]bool),
+	fetched: make(map[string]time.Time),
+}
+
+// The lock isn't held while asking Slack, so one slow lookup doesn't stall every other check
+func (cache *groupCache) isMember(groupID, userID string) (bool, error) {
+	cache.Lock()
+	members := cache.members[groupID]
+	fresh := time.Since(cache.fetched[groupID]) <= groupCacheTimeout
+	cache.Unlock()
+	if fresh {
+		return members[userID], nil
+	}
+	users, err := slackClient.getUserGroupMembers(groupID)
+	if err != nil {
+		return false, err
+	}
+	members = make(map[string]bool)
+	for _, user := range users {
+		members[user] = true
+	}
+	cache.Lock()
+	cache.members[groupID] = members
+	cache.fetched[groupID] = time.Now()
+	cache.Unlock()
+	return members[userID], nil
+}
+
+func allowsAction(actions []string, action string) bool {
+	for _, allowed := range actions {
+		if allowed == "*" || allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Anyone not explicitly granted an action, directly or through a user group, is refused
+func isAuthorized(userID, action string) (bool, error) {
+	auth := config.Slack.Authorization
+	if allowsAction(auth.Users[userID], action) {
+		return true, nil
+	}
+	for groupID, actions := range auth.Groups {
+		if !allowsAction(actions, action) {
+			continue
+		}
+		member, err := userGroups.isMember(groupID, userID)
+		if err != nil {
+			return false, err
+		}
+		if member {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Returns the action requested by the interaction and the team it applies to, if known, along with
+// the targeted user's login for per-user actions
+func (si *Interaction) getAction() (action string, teamID int, login string) {
+	switch si.Actions[0].ActionID {
+	case "rerun_batman", "repost_report":
+		return si.Actions[0].ActionID, 0, ""
+	}
+	value := strings.Split(si.Actions[0].SelectedOption.Value, ":")
+	if len(value) > 1 {
+		teamID, _ = strconv.Atoi(value[1])
+	}
+	if len(value) > 2 {
+		login = value[2]
+	}
+	return value[0], teamID, login
+}
+
+// Checks the actor's permissions, letting them know and logging the attempt if they're refused
+func (si *Interaction) authorize() (bool, error) {
+	action, teamID, _ := si.getAction()
+	allowed, err := isAuthorized(si.User.ID, action)
+	if err != nil {
+		outputErr(err, false)
+		msg := "Sibyl couldn't verify your permissions with Slack—please try again in a moment."
+		return false, si.replyEphemeral(msg)
+	}
+	if allowed {
+		return true, nil
+	}
+	newAuditEvent(si, action, teamID).finish(auditDenied, errActionDenied)
+	msg := "You aren't authorized to do that—ask an administrator if you need access."
+	return false, si.replyEphemeral(msg)
+}
@@ -65,11 +65,64 @@ func (res *BatmanResult) getSize() int {
 	return size
 }
 
-func (res *BatmanResult) mapFunctionsToUsers() map[string][]string {
+func (res *BatmanResult) getMatchedLogins() []string {
+	seen := make(map[string]bool)
+	logins := make([]string, 0)
+	for _, function := range res.MatchedFunctions {
+		for _, match := range function.Matches {
+			if !seen[match.Login] {
+				seen[match.Login] = true
+				logins = append(logins, match.Login)
+			}
+		}
+	}
+	return logins
+}
+
+func (res *BatmanResult) getCodeMatches(teamID int, projectSlug string) []CodeMatch {
+	matches := make([]CodeMatch, 0, res.getSize())
+	for _, function := range res.MatchedFunctions {
+		source := function.Cheater
+		if source == "" {
+			source = res.Login
+		}
+		for _, match := range function.Matches {
+			matches = append(matches, CodeMatch{
+				TeamID:          teamID,
+				ProjectSlug:     projectSlug,
+				SourceLogin:     source,
+				MatchedLogin:    match.Login,
+				Function:        function.Name,
+				MatchedFunction: match.Name,
+				Filename:        match.Filename,
+				MatchDate:       match.Date.Time,
+			})
+		}
+	}
+	return matches
+}
+
+// Code that existed before the team's first commit can't have been copied from them
+func getCopyDirection(matchDate, firstCommit time.Time) string {
+	if matchDate.IsZero() || firstCommit.IsZero() {
+		return "direction unknown"
+	}
+	if matchDate.Before(firstCommit) {
+		return "likely source"
+	}
+	return "likely copier"
+}
+
+func (res *BatmanResult) mapFunctionsToUsers(firstCommit time.Time) map[string][]string {
 	matches := make(map[string][]string)
 	for _, function := range res.MatchedFunctions {
 		for _, match := range function.Matches {
-			key := fmt.Sprintf("%s [%s]", match.Login, match.Date.Format(time.RFC822))
+			key := fmt.Sprintf(
+				"%s [%s] (%s)",
+				match.Login,
+				match.Date.Format(time.RFC822),
+				getCopyDirection(match.Date.Time, firstCommit),
+			)
 			if _, present := matches[key]; !present {
 				matches[key] = make([]string, 0)
 			}
@@ -99,8 +152,8 @@ func indexMatches(matches map[string][]string) []string {
 	return index
 }
 
-func (res *BatmanResult) getFormattedOutput() string {
-	matches := res.mapFunctionsToUsers()
+func (res *BatmanResult) getFormattedOutput(firstCommit time.Time) string {
+	matches := res.mapFunctionsToUsers(firstCommit)
 	breakdown := &strings.Builder{}
 	// Keep track of where user headers will be inserted into aligned output
 	breakdownLengths := make([]int, 0)
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/jinzhu/gorm"
@@ -13,6 +14,10 @@ import (
 type (
 	ErasedExperience struct {
 		gorm.Model
+		IntraID           int
+		Erased            bool
+		Restoring         bool
+		Restored          bool
 		SkillID           int
 		ExperiancableID   int
 		ExperiancableType string
@@ -24,8 +29,13 @@ type (
 	TeamRecordUser struct {
 		gorm.Model
 		UserID            int
+		Login             string
 		ProjectsUserID    int
 		CloseID           *int
+		LockExpiresAt     *time.Time
+		ExternalCloseID   *int
+		Cheated           bool
+		ExpSnapshot       bool
 		ErasedExperiences []ErasedExperience
 		TeamRecordID      uint
 	}
@@ -34,9 +44,95 @@ type (
 		TeamID          int
 		Users           map[int]*TeamRecordUser `gorm:"-"`
 		TeamRecordUsers []TeamRecordUser
+		TeamNotes       []TeamNote
 		OriginalScore   int
 		Cheated         bool
+		CheatingSaga    string
+		SlackChannel    string
+		SlackTS         string
+		ReportBlocks    string `gorm:"type:mediumtext"`
+		LastAction      string
+		LastActorID     string
+		LastActionAt    *time.Time
 	}
+	AuditEvent struct {
+		gorm.Model
+		ActorID       string `gorm:"index"`
+		ActorName     string
+		Action        string
+		TeamID        int `gorm:"index"`
+		AffectedUsers string
+		CloseIDs      string
+		Reason        string `gorm:"type:text"`
+		Note          string `gorm:"type:text"`
+		Result        string
+		Error         string `gorm:"type:text"`
+	}
+	TeamNote struct {
+		gorm.Model
+		TeamRecordID uint `gorm:"index"`
+		ActorID      string
+		Action       string
+		Reason       string `gorm:"type:text"`
+		Note         string `gorm:"type:text"`
+		Duration     time.Duration
+	}
+	CodeMatch struct {
+		gorm.Model
+		TeamID          int    `gorm:"index"`
+		ProjectSlug     string `gorm:"index"`
+		SourceLogin     string `gorm:"index"`
+		MatchedLogin    string `gorm:"index"`
+		Function        string
+		MatchedFunction string
+		Filename        string
+		MatchDate       time.Time
+	}
+	ReportJob struct {
+		gorm.Model
+		DeliveryID     string `gorm:"index"`
+		TeamID         int    `gorm:"index"`
+		ProjectSlug    string `gorm:"index"`
+		FinalMark      int
+		Payload        string `gorm:"type:text"`
+		State          string `gorm:"index"`
+		BatmanAttempts int
+		NextAttemptAt  *time.Time
+		SlackAttempts  int
+		LastError      string `gorm:"type:text"`
+		BatmanStatus   string
+		MatchCount     int
+		MatchedLogins  int
+		Matches        string `gorm:"type:mediumtext"`
+		SlackChannel   string
+		SlackTS        string
+	}
+)
+
+// Flagging and forgiveness touch Intra many times over; the saga in progress is recorded so a retry
+// picks up where the last attempt failed instead of starting over
+const (
+	sagaFlagging  = "flagging"
+	sagaForgiving = "forgiving"
+)
+
+const (
+	auditSucceeded = "succeeded"
+	auditRejected  = "rejected"
+	auditFailed    = "failed"
+	auditDenied    = "denied"
+)
+
+const (
+	jobPendingBatman = "pending_batman"
+	jobPendingSlack  = "pending_slack"
+	jobPosted        = "posted"
+	jobFailed        = "failed"
+	jobDeadBatman    = "dead_batman"
+	jobDeadSlack     = "dead_slack"
+	jobHeldForDigest = "digest"
+	jobDigested      = "digested"
+	jobSuppressed    = "suppressed"
 )
 
 var db *gorm.DB
@@ -51,6 +147,7 @@ func (rec *TeamRecord) create(team *intra.Team) error {
 		for _, user := range team.Users {
 			teamUser := TeamRecordUser{
 				UserID:         user.ID,
+				Login:          user.Login,
 				ProjectsUserID: user.ProjectsUserID,
 				TeamRecordID:   rec.ID,
 			}
@@ -89,14 +186,36 @@ func (rec *TeamRecord) get(teamID int) error {
 	return err
 }
 
-func (rec *TeamRecord) addClose(userClose *intra.UserClose) error {
+func (rec *TeamRecord) getUsers() []*TeamRecordUser {
+	users := make([]*TeamRecordUser, len(rec.TeamRecordUsers))
+	for i := range rec.TeamRecordUsers {
+		users[i] = &rec.TeamRecordUsers[i]
+	}
+	return users
+}
+
+func (rec *TeamRecord) findUser(login string) *TeamRecordUser {
+	for _, user := range rec.Users {
+		if user.Login == login {
+			return user
+		}
+	}
+	return nil
+}
+
+// A nil expiry means the lock stays until someone lifts it
+func (rec *TeamRecord) addClose(userClose *intra.UserClose, expiresAt *time.Time) error {
 	teamUser := rec.Users[userClose.User.ID]
 	closeID := userClose.ID
 	err := db.
 		Model(teamUser).
-		Update("close_id", closeID).Error
+		Updates(map[string]interface{}{
+			"close_id":        closeID,
+			"lock_expires_at": expiresAt,
+		}).Error
 	if err == nil {
 		teamUser.CloseID = &closeID
+		teamUser.LockExpiresAt = expiresAt
 	}
 	return err
 }
@@ -105,51 +224,513 @@ func (rec *TeamRecord) removeClose(userClose *intra.UserClose) error {
 	teamUser := rec.Users[userClose.User.ID]
 	err := db.
 		Model(teamUser).
-		Update("close_id", nil).Error
+		Updates(map[string]interface{}{
+			"close_id":        nil,
+			"lock_expires_at": nil,
+		}).Error
 	if err == nil {
 		teamUser.CloseID = nil
+		teamUser.LockExpiresAt = nil
 	}
 	return err
 }
 
-func (rec *TeamRecord) setCheated(cheated bool) error {
+func (rec *TeamRecord) setCheatingSaga(saga string) error {
 	err := db.
 		Model(rec).
-		Update("cheated", cheated).Error
+		Update("cheating_saga", saga).Error
+	if err == nil {
+		rec.CheatingSaga = saga
+	}
+	return err
+}
+
+// Closes out the saga in progress, leaving the team flagged or cleared
+func (rec *TeamRecord) finishCheatingSaga(cheated bool) error {
+	err := db.
+		Model(rec).
+		Updates(map[string]interface{}{
+			"cheated":       cheated,
+			"cheating_saga": "",
+		}).Error
 	if err == nil {
 		rec.Cheated = cheated
+		rec.CheatingSaga = ""
 	}
 	return err
 }
 
-func (user *TeamRecordUser) addErasedExp(exp *intra.Experience) error {
-	erased := ErasedExperience{
-		SkillID:           exp.SkillID,
-		ExperiancableID:   exp.ExperiancableID,
-		ExperiancableType: exp.ExperiancableType,
-		Amount:            exp.Amount,
-		CreationTime:      exp.CreatedAt,
-		CursusID:          exp.CursusID,
-		TeamRecordUserID:  user.ID,
+// Remembers where the team's report was posted, and what it looked like, so it can be threaded
+// under and re-rendered later
+func (rec *TeamRecord) setSlackMessage(channel, ts, blocks string) error {
+	err := db.
+		Model(rec).
+		Updates(map[string]interface{}{
+			"slack_channel": channel,
+			"slack_ts":      ts,
+			"report_blocks": blocks,
+		}).Error
+	if err == nil {
+		rec.SlackChannel = channel
+		rec.SlackTS = ts
+		rec.ReportBlocks = blocks
 	}
-	return db.
+	return err
+}
+
+func (rec *TeamRecord) addNote(note *TeamNote) error {
+	note.TeamRecordID = rec.ID
+	err := db.Create(note).Error
+	if err == nil {
+		rec.TeamNotes = append(rec.TeamNotes, *note)
+	}
+	return err
+}
+
+func (rec *TeamRecord) setLastAction(action, actorID string) error {
+	now := time.Now()
+	err := db.
+		Model(rec).
+		Updates(map[string]interface{}{
+			"last_action":    action,
+			"last_actor_id":  actorID,
+			"last_action_at": &now,
+		}).Error
+	if err == nil {
+		rec.LastAction = action
+		rec.LastActorID = actorID
+		rec.LastActionAt = &now
+	}
+	return err
+}
+
+// Records every experience about to be erased before anything is deleted, so a retry works through
+// the same set rather than whatever Intra returns at that point
+func (user *TeamRecordUser) snapshotExperiences(experiences intra.Experiences) error {
+	snapshot := make([]ErasedExperience, len(experiences))
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i, exp := range experiences {
+			snapshot[i] = ErasedExperience{
+				IntraID:           exp.ID,
+				SkillID:           exp.SkillID,
+				ExperiancableID:   exp.ExperiancableID,
+				ExperiancableType: exp.ExperiancableType,
+				Amount:            exp.Amount,
+				CreationTime:      exp.CreatedAt,
+				CursusID:          exp.CursusID,
+				TeamRecordUserID:  user.ID,
+			}
+			if err := tx.Create(&snapshot[i]).Error; err != nil {
+				return err
+			}
+		}
+		return tx.
+			Model(user).
+			Update("exp_snapshot", true).Error
+	})
+	if err == nil {
+		user.ErasedExperiences = append(user.ErasedExperiences, snapshot...)
+		user.ExpSnapshot = true
+	}
+	return err
+}
+
+func (user *TeamRecordUser) setCheated(cheated bool) error {
+	err := db.
+		Model(user).
+		Update("cheated", cheated).Error
+	if err == nil {
+		user.Cheated = cheated
+	}
+	return err
+}
+
+func (user *TeamRecordUser) clearExpSnapshot() error {
+	err := db.
 		Model(user).
-		Association("ErasedExperiences").
-		Append(erased).Error
+		Update("exp_snapshot", false).Error
+	if err == nil {
+		user.ExpSnapshot = false
+	}
+	return err
+}
+
+func (erased *ErasedExperience) setErased() error {
+	err := db.
+		Model(erased).
+		Update("erased", true).Error
+	if err == nil {
+		erased.Erased = true
+	}
+	return err
+}
+
+// Set before recreating the experience, so a retry knows Intra may already have it
+func (erased *ErasedExperience) setRestoring() error {
+	err := db.
+		Model(erased).
+		Update("restoring", true).Error
+	if err == nil {
+		erased.Restoring = true
+	}
+	return err
+}
+
+func (erased *ErasedExperience) setRestored() error {
+	err := db.
+		Model(erased).
+		Update("restored", true).Error
+	if err == nil {
+		erased.Restored = true
+	}
+	return err
 }
 
-func (user *TeamRecordUser) removeErasedExp(exp *intra.Experience) error {
-	for _, erased := range user.ErasedExperiences {
-		if erased.ExperiancableID == exp.ExperiancableID {
-			return db.
-				Model(user).
-				Association("ErasedExperiences").
-				Delete(erased).Error
+func (user *TeamRecordUser) removeErasedExp(erased *ErasedExperience) error {
+	err := db.Delete(erased).Error
+	if err != nil {
+		return err
+	}
+	for i := range user.ErasedExperiences {
+		if user.ErasedExperiences[i].ID == erased.ID {
+			user.ErasedExperiences = append(user.ErasedExperiences[:i], user.ErasedExperiences[i+1:]...)
+			break
 		}
 	}
 	return nil
 }
 
+func (rec *TeamRecord) getByID(recordID uint) error {
+	teamRecord := &TeamRecord{}
+	if err := db.First(teamRecord, recordID).Error; err != nil {
+		return err
+	}
+	return rec.get(teamRecord.TeamID)
+}
+
+// Teams Sibyl has acted on are the only ones whose closes it has an opinion about
+func getModeratedTeamIDs() (teamIDs []int, err error) {
+	err = db.
+		Model(&TeamRecord{}).
+		Where("last_action_at IS NOT NULL").
+		Pluck("team_id", &teamIDs).Error
+	return
+}
+
+func (user *TeamRecordUser) setExternalClose(closeID *int) error {
+	err := db.
+		Model(user).
+		Update("external_close_id", closeID).Error
+	if err == nil {
+		user.ExternalCloseID = closeID
+	}
+	return err
+}
+
+// Every close Sibyl has on record for the user, across all of their teams
+func getSibylCloseIDs(userID int) (closeIDs []int, err error) {
+	err = db.
+		Model(&TeamRecordUser{}).
+		Where("user_id = ? AND close_id IS NOT NULL", userID).
+		Pluck("close_id", &closeIDs).Error
+	return
+}
+
+func getExpiredLocks() (users []TeamRecordUser, err error) {
+	err = db.
+		Where("close_id IS NOT NULL AND lock_expires_at <= ?", time.Now()).
+		Find(&users).Error
+	return
+}
+
+func (event *AuditEvent) create() error {
+	return db.Create(event).Error
+}
+
+func getAuditEventsForTeam(teamID int) (events []AuditEvent, err error) {
+	err = db.
+		Where("team_id = ?", teamID).
+		Order("id").
+		Find(&events).Error
+	return
+}
+
+func getAuditEventsForActor(actorID string) (events []AuditEvent, err error) {
+	err = db.
+		Where("actor_id = ?", actorID).
+		Order("id").
+		Find(&events).Error
+	return
+}
+
+func (job *ReportJob) create(deliveryID string, team *intra.WebTeam, payload []byte) error {
+	job.DeliveryID = deliveryID
+	job.TeamID = team.ID
+	job.ProjectSlug = team.Project.Slug
+	job.FinalMark = team.FinalMark
+	job.Payload = string(payload)
+	job.State = jobPendingBatman
+	return db.Create(job).Error
+}
+
+func (job *ReportJob) save() error {
+	return db.Save(job).Error
+}
+
+func (job *ReportJob) get(jobID uint) error {
+	return db.First(job, jobID).Error
+}
+
+// Puts a dead-lettered job back where it gave up; the state is checked in the update itself so
+// only one of several simultaneous requeues wins
+func (job *ReportJob) revive() (bool, error) {
+	updates := map[string]interface{}{
+		"state":           jobPendingBatman,
+		"batman_attempts": 0,
+	}
+	if job.State == jobDeadSlack {
+		updates = map[string]interface{}{
+			"state":          jobPendingSlack,
+			"slack_attempts": 0,
+		}
+	}
+	result := db.
+		Model(&ReportJob{}).
+		Where("id = ? AND state IN (?)", job.ID, []string{jobDeadBatman, jobDeadSlack}).
+		Updates(updates)
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false, result.Error
+	}
+	if job.State == jobDeadSlack {
+		job.State = jobPendingSlack
+		job.SlackAttempts = 0
+	} else {
+		job.State = jobPendingBatman
+		job.BatmanAttempts = 0
+	}
+	return true, nil
+}
+
+func (job *ReportJob) setState(state string) error {
+	job.State = state
+	return job.save()
+}
+
+// Intra retries webhooks it considers undelivered, and occasionally fires the same mark twice
+// under different delivery IDs, so both are treated as duplicates unless the earlier job failed
+func isDuplicateDelivery(deliveryID string, teamID, finalMark int) (bool, error) {
+	count := 0
+	query := db.Model(&ReportJob{}).Where("state <> ?", jobFailed)
+	if deliveryID != "" {
+		query = query.Where(
+			"delivery_id = ? OR (team_id = ? AND final_mark = ?)",
+			deliveryID,
+			teamID,
+			finalMark,
+		)
+	} else {
+		query = query.Where("team_id = ? AND final_mark = ?", teamID, finalMark)
+	}
+	err := query.Count(&count).Error
+	return count > 0, err
+}
+
+// Returns jobs that were still waiting on Batman or Slack when the process last stopped; jobs
+// created since are already on their way through the queue
+func getUnfinishedJobs(before time.Time) (jobs []ReportJob, err error) {
+	err = db.
+		Where("state IN (?) AND created_at < ?", []string{jobPendingBatman, jobPendingSlack}, before).
+		Order("id").
+		Find(&jobs).Error
+	return
+}
+
+// Returns jobs that gave up on Batman or Slack and are waiting on a human
+func getDeadLetterJobs() (jobs []ReportJob, err error) {
+	err = db.
+		Where("state IN (?)", []string{jobDeadBatman, jobDeadSlack}).
+		Order("id").
+		Find(&jobs).Error
+	return
+}
+
+func getDigestJobs() (jobs []ReportJob, err error) {
+	err = db.
+		Where("state = ?", jobHeldForDigest).
+		Order("id").
+		Find(&jobs).Error
+	return
+}
+
+func markJobsDigested(jobs []ReportJob) error {
+	ids := make([]uint, len(jobs))
+	for i, job := range jobs {
+		ids[i] = job.ID
+	}
+	return db.
+		Model(&ReportJob{}).
+		Where("id IN (?)", ids).
+		Update("state", jobDigested).Error
+}
+
+func getJobsForTeam(teamID int) (jobs []ReportJob, err error) {
+	err = db.
+		Where("team_id = ?", teamID).
+		Order("id").
+		Find(&jobs).Error
+	return
+}
+
+func getTeamIDsForProject(slug string, limit int) (teamIDs []int, err error) {
+	err = db.
+		Model(&ReportJob{}).
+		Where("project_slug = ?", slug).
+		Group("team_id").
+		Order("MAX(id) DESC").
+		Limit(limit).
+		Pluck("team_id", &teamIDs).Error
+	return
+}
+
+func getTeamIDsForLogin(login string) (teamIDs []int, err error) {
+	err = db.
+		Table("team_records").
+		Joins("JOIN team_record_users ON team_record_users.team_record_id = team_records.id").
+		Where("team_record_users.login = ? AND team_record_users.deleted_at IS NULL", login).
+		Where("team_records.deleted_at IS NULL").
+		Order("team_records.id DESC").
+		Pluck("team_records.team_id", &teamIDs).Error
+	return
+}
+
+// Counts other teams on which the user was flagged for cheating or locked; locks that have since
+// expired or been lifted only survive in the audit log. Records are matched by Intra user ID, since
+// older ones may not have a login yet, and audit events name users by login or, failing that, ID.
+func countPriorOffenses(userID int, login string, excludeTeamID int) (int, error) {
+	var flagged, locked []int
+	err := db.
+		Table("team_record_users").
+		Joins("JOIN team_records ON team_records.id = team_record_users.team_record_id").
+		Where("team_record_users.user_id = ? AND team_records.team_id <> ?", userID, excludeTeamID).
+		Where(
+			"team_record_users.cheated = ? OR team_records.cheated = ? OR team_record_users.close_id IS NOT NULL",
+			true,
+			true,
+		).
+		Where("team_record_users.deleted_at IS NULL AND team_records.deleted_at IS NULL").
+		Pluck("team_records.team_id", &flagged).Error
+	if err != nil {
+		return 0, err
+	}
+	err = db.
+		Model(&AuditEvent{}).
+		Where("action IN (?) AND result = ?", []string{"lock", "lock_user"}, auditSucceeded).
+		Where(
+			"team_id <> ? AND (FIND_IN_SET(?, affected_users) > 0 OR FIND_IN_SET(?, affected_users) > 0)",
+			excludeTeamID,
+			login,
+			strconv.Itoa(userID),
+		).
+		Pluck("team_id", &locked).Error
+	if err != nil {
+		return 0, err
+	}
+	teams := make(map[int]bool)
+	for _, teamID := range append(flagged, locked...) {
+		teams[teamID] = true
+	}
+	return len(teams), nil
+}
+
+// Teams with users recorded before logins were stored
+func getTeamIDsMissingLogins() (teamIDs []int, err error) {
+	err = db.
+		Table("team_records").
+		Joins("JOIN team_record_users ON team_record_users.team_record_id = team_records.id").
+		Where("team_record_users.login IS NULL OR team_record_users.login = ?", "").
+		Where("team_record_users.deleted_at IS NULL AND team_records.deleted_at IS NULL").
+		Group("team_records.team_id").
+		Pluck("team_records.team_id", &teamIDs).Error
+	return
+}
+
+func (rec *TeamRecord) setLogins(team *intra.Team) error {
+	for _, user := range team.Users {
+		teamUser := rec.Users[user.ID]
+		if teamUser == nil || teamUser.Login != "" {
+			continue
+		}
+		if err := db.Model(teamUser).Update("login", user.Login).Error; err != nil {
+			return err
+		}
+		teamUser.Login = user.Login
+	}
+	return nil
+}
+
+// Fills in logins for records made before they were stored, so lookups by login and per-user
+// actions work on older teams too; runs in the background since it asks Intra about every such team
+func backfillLogins() {
+	teamIDs, err := getTeamIDsMissingLogins()
+	if err != nil {
+		outputErr(err, false)
+		return
+	}
+	for _, teamID := range teamIDs {
+		rec := &TeamRecord{}
+		team := &intra.Team{ID: teamID}
+		err := rec.get(teamID)
+		if err == nil {
+			err = team.Get(context.Background(), false)
+		}
+		if err == nil {
+			err = rec.setLogins(team)
+		}
+		if err != nil {
+			outputErr(fmt.Errorf("unable to backfill logins for team %d: %s", teamID, err.Error()), false)
+		}
+	}
+}
+
+// Unlike get, doesn't go to Intra when Sibyl has no record of the team; returns nil instead
+func findTeamRecord(teamID int) (*TeamRecord, error) {
+	rec := &TeamRecord{}
+	err := db.
+		Where("team_id = ?", teamID).
+		Preload("TeamRecordUsers").
+		Preload("TeamRecordUsers.ErasedExperiences").
+		First(rec).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	return rec, err
+}
+
+// Replaces whatever was recorded from an earlier Batman run for the team
+func saveCodeMatches(teamID int, matches []CodeMatch) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("team_id = ?", teamID).Delete(&CodeMatch{}).Error; err != nil {
+			return err
+		}
+		for i := range matches {
+			if err := tx.Create(&matches[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reads back the matches recorded from earlier Batman runs, optionally for a single project
+func loadCodeMatches(projectSlug string) (matches []CodeMatch, err error) {
+	query := db.Order("id")
+	if projectSlug != "" {
+		query = query.Where("project_slug = ?", projectSlug)
+	}
+	err = query.Find(&matches).Error
+	return
+}
+
 func openDatabaseConnection() (err error) {
 	uri := fmt.Sprintf("%s:%s@(%s)/%s",
 		config.Database.User,
@@ -160,11 +741,50 @@ func openDatabaseConnection() (err error) {
 	if db, err = gorm.Open("mysql", uri); err == nil {
 		db.DB().SetConnMaxLifetime(time.Minute * 15)
 		db.DB().SetMaxIdleConns(0)
-		err = db.AutoMigrate(
-			&ErasedExperience{},
-			&TeamRecord{},
-			&TeamRecordUser{},
-		).Error
+		err = migrateDatabase()
 	}
 	return
 }
+
+func migrateDatabase() error {
+	err := db.AutoMigrate(
+		&AuditEvent{},
+		&CodeMatch{},
+		&ErasedExperience{},
+		&ReportJob{},
+		&TeamNote{},
+		&TeamRecord{},
+		&TeamRecordUser{},
+	).Error
+	if err != nil {
+		return err
+	}
+	return migrateLegacyErasures()
+}
+
+// Rows from before experiences were snapshotted were only written once Intra had deleted the
+// experience, but come out of AutoMigrate looking never erased; without this, forgiving those teams
+// would throw the records away instead of giving the experience back. Users are marked as snapshotted
+// along with their rows, so once applied this never matches anything again.
+func migrateLegacyErasures() error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(
+			"UPDATE erased_experiences SET erased = ? "+
+				"WHERE erased = ? AND deleted_at IS NULL AND team_record_user_id IN "+
+				"(SELECT id FROM team_record_users WHERE exp_snapshot = ?)",
+			true,
+			false,
+			false,
+		).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(
+			"UPDATE team_record_users SET exp_snapshot = ? "+
+				"WHERE exp_snapshot = ? AND id IN "+
+				"(SELECT team_record_user_id FROM erased_experiences WHERE deleted_at IS NULL)",
+			true,
+			false,
+		).Error
+	})
+}
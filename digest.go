@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/stephen-gardner/intra"
+)
+
+type (
+	digestProject struct {
+		slug   string
+		counts map[string]int
+		teams  []string
+		jobs   []ReportJob
+	}
+	digestMessage struct {
+		blocks string
+		jobs   []ReportJob
+	}
+)
+
+const (
+	// Slack caps messages at 50 blocks and section text at 3000 characters
+	digestProjectsPerMessage = 45
+	digestTeamsPerProject    = 20
+)
+
+func getDigestCategory(status string) string {
+	switch status {
+	case batmanClean, batmanEmpty, batmanNotApplicable:
+		return status
+	}
+	return "low signal"
+}
+
+func groupDigestJobs(jobs []ReportJob) []*digestProject {
+	projects := make(map[string]*digestProject)
+	for _, job := range jobs {
+		team := &intra.WebTeam{}
+		if err := json.Unmarshal([]byte(job.Payload), team); err != nil {
+			outputErr(err, false)
+			continue
+		}
+		project, present := projects[team.Project.Slug]
+		if !present {
+			project = &digestProject{slug: team.Project.Slug, counts: make(map[string]int)}
+			projects[team.Project.Slug] = project
+		}
+		project.counts[getDigestCategory(job.BatmanStatus)]++
+		project.jobs = append(project.jobs, job)
+		project.teams = append(project.teams, fmt.Sprintf(
+			"<https://projects.intra.42.fr/projects/%s/projects_users/%s|%s>",
+			team.Project.Slug,
+			team.Leader.Login,
+			team.Name,
+		))
+	}
+	sorted := make([]*digestProject, 0, len(projects))
+	for _, project := range projects {
+		sorted = append(sorted, project)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return strings.Compare(sorted[i].slug, sorted[j].slug) < 0
+	})
+	return sorted
+}
+
+func (project *digestProject) getSummary() string {
+	categories := make([]string, 0, len(project.counts))
+	for category := range project.counts {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	total := 0
+	for i, category := range categories {
+		total += project.counts[category]
+		categories[i] = fmt.Sprintf("%d %s", project.counts[category], category)
+	}
+	teams := project.teams
+	more := ""
+	if len(teams) > digestTeamsPerProject {
+		more = fmt.Sprintf(" …and %d more", len(teams)-digestTeamsPerProject)
+		teams = teams[:digestTeamsPerProject]
+	}
+	return fmt.Sprintf(
+		"*<https://projects.intra.42.fr/projects/%s|%s>* — %d teams (%s)\n%s%s",
+		project.slug,
+		project.slug,
+		total,
+		strings.Join(categories, ", "),
+		strings.Join(teams, ", "),
+		more,
+	)
+}
+
+// Splits the digest into messages Slack will accept, each carrying the jobs it covers
+func composeDigestMessages(projects []*digestProject, total int) []digestMessage {
+	type text struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type block struct {
+		Type string `json:"type"`
+		Text *text  `json:"text,omitempty"`
+	}
+	messages := make([]digestMessage, 0)
+	for start := 0; start < len(projects); start += digestProjectsPerMessage {
+		end := start + digestProjectsPerMessage
+		if end > len(projects) {
+			end = len(projects)
+		}
+		blocks := make([]block, 0, end-start+2)
+		if start == 0 {
+			header := fmt.Sprintf(":newspaper: *Daily digest:* %d teams weren't worth a report of their own", total)
+			blocks = append(blocks, block{Type: "section", Text: &text{Type: "mrkdwn", Text: header}})
+			blocks = append(blocks, block{Type: "divider"})
+		}
+		jobs := make([]ReportJob, 0)
+		for _, project := range projects[start:end] {
+			blocks = append(blocks, block{Type: "section", Text: &text{Type: "mrkdwn", Text: project.getSummary()}})
+			jobs = append(jobs, project.jobs...)
+		}
+		data, _ := json.Marshal(blocks)
+		messages = append(messages, digestMessage{blocks: string(data), jobs: jobs})
+	}
+	return messages
+}
+
+// Each channel gets a digest of the reports that would have been routed to it
+func postDigest() error {
+	jobs, err := getDigestJobs()
+	if err != nil || len(jobs) == 0 {
+		return err
+	}
+	channels := make(map[string][]ReportJob)
+	for _, job := range jobs {
+		channel := job.SlackChannel
+		if channel == "" {
+			channel = config.Slack.Channel
+		}
+		channels[channel] = append(channels[channel], job)
+	}
+	for channel, channelJobs := range channels {
+		// Jobs are marked as each message goes out, so a failure partway doesn't repost the rest tomorrow
+		for _, message := range composeDigestMessages(groupDigestJobs(channelJobs), len(channelJobs)) {
+			if _, err := slackClient.postMessage(channel, "", message.blocks, ""); err != nil {
+				return err
+			}
+			if err := markJobsDigested(message.jobs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns how long until the configured time of day (HH:MM, local) next comes around
+func untilNextDigest(now time.Time) (time.Duration, error) {
+	at, err := time.ParseInLocation("15:04", config.Reporting.DigestTime, time.Local)
+	if err != nil {
+		return 0, err
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.Local)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(now), nil
+}
+
+func runDigest() {
+	if !config.Reporting.Digest {
+		return
+	}
+	for {
+		delay, err := untilNextDigest(time.Now())
+		if err != nil {
+			outputErr(err, false)
+			return
+		}
+		time.Sleep(delay)
+		if err := postDigest(); err != nil {
+			outputErr(err, false)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestComposeDigestMessages(t *testing.T) {
+	projects := make([]*digestProject, digestProjectsPerMessage+5)
+	total := 0
+	for i := range projects {
+		projects[i] = &digestProject{
+			slug:   fmt.Sprintf("project-%02d", i),
+			counts: map[string]int{batmanClean: 2},
+			teams:  []string{"a", "b"},
+			jobs:   []ReportJob{{}, {}},
+		}
+		projects[i].jobs[0].ID = uint(2 * i)
+		projects[i].jobs[1].ID = uint(2*i + 1)
+		total += 2
+	}
+	messages := composeDigestMessages(projects, total)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	// Each message carries exactly the jobs it lists, so it can be marked on its own
+	if len(messages[0].jobs) != 2*digestProjectsPerMessage || len(messages[1].jobs) != 10 {
+		t.Errorf("jobs split wrong: %d + %d", len(messages[0].jobs), len(messages[1].jobs))
+	}
+	if messages[1].jobs[0].ID != uint(2*digestProjectsPerMessage) {
+		t.Errorf("second message starts at job %d", messages[1].jobs[0].ID)
+	}
+	for i, message := range messages {
+		blocks := make([]map[string]interface{}, 0)
+		if err := json.Unmarshal([]byte(message.blocks), &blocks); err != nil {
+			t.Fatalf("message %d isn't valid JSON: %s", i, err)
+		}
+		if len(blocks) > 50 {
+			t.Errorf("message %d has %d blocks", i, len(blocks))
+		}
+	}
+	if messages := composeDigestMessages(nil, 0); len(messages) != 0 {
+		t.Errorf("empty digest produced %d messages", len(messages))
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	graphNode struct {
+		Login   string `json:"login"`
+		Cluster int    `json:"cluster"`
+	}
+	graphEdge struct {
+		Source   string   `json:"source"`
+		Target   string   `json:"target"`
+		Matches  int      `json:"matches"`
+		Projects []string `json:"projects"`
+	}
+	matchGraph struct {
+		Nodes []graphNode  `json:"nodes"`
+		Edges []*graphEdge `json:"edges"`
+	}
+)
+
+func findRoot(parents map[string]string, login string) string {
+	for parents[login] != login {
+		parents[login] = parents[parents[login]]
+		login = parents[login]
+	}
+	return login
+}
+
+// Builds an undirected graph of students whose code matched, numbering its connected components as clusters
+func buildMatchGraph(matches []CodeMatch, minMatches int) *matchGraph {
+	edges := make(map[[2]string]*graphEdge)
+	projects := make(map[[2]string]map[string]bool)
+	for _, match := range matches {
+		if match.SourceLogin == match.MatchedLogin {
+			continue
+		}
+		key := [2]string{match.SourceLogin, match.MatchedLogin}
+		if key[0] > key[1] {
+			key[0], key[1] = key[1], key[0]
+		}
+		edge, present := edges[key]
+		if !present {
+			edge = &graphEdge{Source: key[0], Target: key[1]}
+			edges[key] = edge
+			projects[key] = make(map[string]bool)
+		}
+		edge.Matches++
+		if match.ProjectSlug != "" {
+			projects[key][match.ProjectSlug] = true
+		}
+	}
+	graph := &matchGraph{Nodes: make([]graphNode, 0), Edges: make([]*graphEdge, 0)}
+	parents := make(map[string]string)
+	for key, edge := range edges {
+		if edge.Matches < minMatches {
+			continue
+		}
+		for project := range projects[key] {
+			edge.Projects = append(edge.Projects, project)
+		}
+		sort.Strings(edge.Projects)
+		graph.Edges = append(graph.Edges, edge)
+		for _, login := range key {
+			if _, present := parents[login]; !present {
+				parents[login] = login
+			}
+		}
+		parents[findRoot(parents, key[0])] = findRoot(parents, key[1])
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].Source == graph.Edges[j].Source {
+			return graph.Edges[i].Target < graph.Edges[j].Target
+		}
+		return graph.Edges[i].Source < graph.Edges[j].Source
+	})
+	logins := make([]string, 0, len(parents))
+	for login := range parents {
+		logins = append(logins, login)
+	}
+	sort.Strings(logins)
+	clusters := make(map[string]int)
+	for _, login := range logins {
+		root := findRoot(parents, login)
+		if _, present := clusters[root]; !present {
+			clusters[root] = len(clusters) + 1
+		}
+		graph.Nodes = append(graph.Nodes, graphNode{Login: login, Cluster: clusters[root]})
+	}
+	return graph
+}
+
+// Narrows the graph down to the cluster the login belongs to
+func (graph *matchGraph) filterCluster(login string) {
+	cluster := 0
+	for _, node := range graph.Nodes {
+		if node.Login == login {
+			cluster = node.Cluster
+		}
+	}
+	members := make(map[string]bool)
+	nodes := make([]graphNode, 0)
+	for _, node := range graph.Nodes {
+		if node.Cluster == cluster {
+			members[node.Login] = true
+			nodes = append(nodes, node)
+		}
+	}
+	edges := make([]*graphEdge, 0)
+	for _, edge := range graph.Edges {
+		if members[edge.Source] {
+			edges = append(edges, edge)
+		}
+	}
+	graph.Nodes = nodes
+	graph.Edges = edges
+}
+
+func (graph *matchGraph) toDOT() string {
+	sb := &strings.Builder{}
+	sb.WriteString("graph sibyl {\n")
+	for _, node := range graph.Nodes {
+		_, _ = fmt.Fprintf(sb, "\t%q [group=%d];\n", node.Login, node.Cluster)
+	}
+	for _, edge := range graph.Edges {
+		_, _ = fmt.Fprintf(sb, "\t%q -- %q [label=%q, weight=%d];\n",
+			edge.Source,
+			edge.Target,
+			fmt.Sprintf("%d (%s)", edge.Matches, strings.Join(edge.Projects, ", ")),
+			edge.Matches,
+		)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+func handleMatchGraph(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if !verifyAPIToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	minMatches := 1
+	if min := query.Get("min"); min != "" {
+		var err error
+		if minMatches, err = strconv.Atoi(min); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	matches, err := loadCodeMatches(query.Get("project"))
+	if err != nil {
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	graph := buildMatchGraph(matches, minMatches)
+	if login := query.Get("login"); login != "" {
+		graph.filterCluster(login)
+	}
+	switch query.Get("format") {
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		_, _ = w.Write([]byte(graph.toDOT()))
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(graph); err != nil {
+			outputErr(err, false)
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestBuildMatchGraph(t *testing.T) {
+	matches := []CodeMatch{
+		{SourceLogin: "alice", MatchedLogin: "bob", ProjectSlug: "libft"},
+		{SourceLogin: "bob", MatchedLogin: "alice", ProjectSlug: "ft_printf"},
+		{SourceLogin: "bob", MatchedLogin: "carol", ProjectSlug: "libft"},
+		{SourceLogin: "dave", MatchedLogin: "erin"},
+		{SourceLogin: "frank", MatchedLogin: "frank", ProjectSlug: "libft"},
+	}
+	graph := buildMatchGraph(matches, 1)
+	if len(graph.Edges) != 3 {
+		t.Fatalf("expected 3 edges, got %d", len(graph.Edges))
+	}
+	ab := graph.Edges[0]
+	if ab.Source != "alice" || ab.Target != "bob" || ab.Matches != 2 ||
+		len(ab.Projects) != 2 || ab.Projects[0] != "ft_printf" || ab.Projects[1] != "libft" {
+		t.Errorf("matches in both directions weren't merged: %+v", ab)
+	}
+	if de := graph.Edges[2]; len(de.Projects) != 0 {
+		t.Errorf("empty project slug listed: %+v", de)
+	}
+	clusters := make(map[string]int)
+	for _, node := range graph.Nodes {
+		clusters[node.Login] = node.Cluster
+	}
+	if len(clusters) != 5 {
+		t.Errorf("expected 5 nodes, got %+v", graph.Nodes)
+	}
+	if _, present := clusters["frank"]; present {
+		t.Errorf("self-match became a node")
+	}
+	if clusters["alice"] != clusters["carol"] || clusters["alice"] == clusters["dave"] || clusters["dave"] != clusters["erin"] {
+		t.Errorf("wrong clusters: %+v", clusters)
+	}
+
+	graph = buildMatchGraph(matches, 2)
+	if len(graph.Edges) != 1 || len(graph.Nodes) != 2 {
+		t.Errorf("minimum matches not applied: %+v %+v", graph.Edges, graph.Nodes)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/stephen-gardner/intra"
+)
+
+type (
+	// Every call that changes something in Intra goes through here so staging can swap in a recorder
+	intraWriter interface {
+		createClose(userClose *intra.UserClose) error
+		unclose(userClose *intra.UserClose) error
+		deleteExperience(exp *intra.Experience) error
+		createExperience(exp *intra.Experience) error
+		patchTeam(teamID int, params url.Values) error
+	}
+	liveIntraWriter   struct{}
+	dryRunIntraWriter struct{}
+)
+
+var intraWrites intraWriter = liveIntraWriter{}
+
+// Closes created in dry-run mode get negative IDs so they can never be mistaken for real ones
+var dryRunSeq = time.Now().Unix()
+
+func isDryRunCloseID(closeID int) bool {
+	return closeID < 0
+}
+
+func (liveIntraWriter) createClose(userClose *intra.UserClose) error {
+	return userClose.Create(context.Background(), false, intra.CloseKindOther)
+}
+
+func (liveIntraWriter) unclose(userClose *intra.UserClose) error {
+	err := userClose.Get(context.Background(), false)
+	if err == nil {
+		err = userClose.Unclose(context.Background(), false)
+	}
+	return err
+}
+
+func (liveIntraWriter) deleteExperience(exp *intra.Experience) error {
+	return exp.Delete(context.Background())
+}
+
+func (liveIntraWriter) createExperience(exp *intra.Experience) error {
+	return exp.Create(context.Background(), false)
+}
+
+func (liveIntraWriter) patchTeam(teamID int, params url.Values) error {
+	team := &intra.Team{ID: teamID}
+	err := team.Get(context.Background(), false)
+	if err == nil {
+		err = team.Patch(context.Background(), false, params)
+	}
+	return err
+}
+
+func (dryRunIntraWriter) createClose(userClose *intra.UserClose) error {
+	userClose.ID = -int(atomic.AddInt64(&dryRunSeq, 1))
+	log.Printf("[dry run] UserClose.Create user=%d kind=%s reason=%q -> id=%d\n",
+		userClose.User.ID,
+		intra.CloseKindOther,
+		userClose.Reason,
+		userClose.ID,
+	)
+	return nil
+}
+
+func (dryRunIntraWriter) unclose(userClose *intra.UserClose) error {
+	log.Printf("[dry run] UserClose.Unclose id=%d user=%d\n", userClose.ID, userClose.User.ID)
+	return nil
+}
+
+func (dryRunIntraWriter) deleteExperience(exp *intra.Experience) error {
+	log.Printf("[dry run] Experience.Delete id=%d amount=%d\n", exp.ID, exp.Amount)
+	return nil
+}
+
+func (dryRunIntraWriter) createExperience(exp *intra.Experience) error {
+	log.Printf("[dry run] Experience.Create user=%d skill=%d amount=%d\n", exp.UserID, exp.SkillID, exp.Amount)
+	return nil
+}
+
+func (dryRunIntraWriter) patchTeam(teamID int, params url.Values) error {
+	log.Printf("[dry run] Team.Patch id=%d params=%s\n", teamID, params.Encode())
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const lockExpiryInterval = time.Minute
+
+// Posts in the report's thread when there is one, otherwise to the channel it would have gone to
+func (rec *TeamRecord) postNotice(msg string) error {
+	channel := rec.SlackChannel
+	if channel == "" {
+		channel = config.Slack.Channel
+	}
+	_, err := slackClient.postMessage(channel, rec.SlackTS, "", msg)
+	return err
+}
+
+func expireLock(expired *TeamRecordUser) error {
+	rec := &TeamRecord{}
+	if err := rec.getByID(expired.TeamRecordID); err != nil {
+		return err
+	}
+	defer teamLocks.lock(rec.TeamID)()
+	// Someone may have unlocked or relocked the user while we waited our turn
+	teamID := rec.TeamID
+	rec = &TeamRecord{}
+	if err := rec.get(teamID); err != nil {
+		return err
+	}
+	user := rec.Users[expired.UserID]
+	if user == nil || user.CloseID == nil || expired.CloseID == nil || *user.CloseID != *expired.CloseID ||
+		user.LockExpiresAt == nil || user.LockExpiresAt.After(time.Now()) {
+		return nil
+	}
+	event := newSystemAuditEvent("unlock_user", rec.TeamID)
+	event.setAffectedUsers([]*TeamRecordUser{user})
+	before := snapshotCloses(rec)
+	err := unlockUser(rec, user)
+	event.setCloseChanges(before, rec)
+	if err != nil {
+		event.finish(auditFailed, err)
+		return err
+	}
+	event.finish(auditSucceeded, nil)
+	if err := rec.setLastAction("unlock_user:"+user.Login, ""); err != nil {
+		outputErr(err, false)
+	} else if err := rec.updateReportMessage(); err != nil {
+		outputErr(err, false)
+	}
+	return rec.postNotice(fmt.Sprintf("%s's lock has expired; they have been automatically unlocked.", user.Login))
+}
+
+// Lifts locks whose time is up through the same path as a manual unlock
+func runLockExpiry() {
+	for range time.Tick(lockExpiryInterval) {
+		expired, err := getExpiredLocks()
+		if err != nil {
+			outputErr(err, false)
+			continue
+		}
+		for i := range expired {
+			if err := expireLock(&expired[i]); err != nil {
+				outputErr(err, false)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"time"
 
@@ -14,25 +15,57 @@ import (
 type Config struct {
 	ListenDomain string `json:"listenDomain"`
 	ListenPort   int    `json:"listenPort"`
+	DryRun       bool   `json:"dryRun"`
 	Database     struct {
 		Address  string `json:"address"`
 		User     string `json:"user"`
 		Password string `json:"password"`
 		Name     string `json:"name"`
 	} `json:"database"`
-	CampusDomain      string `json:"campusDomain"`
-	BatmanEndpoint    string `json:"batmanEndpoint"`
-	BatmanMaxAttempts int    `json:"batmanMaxAttempts"`
-	Vogsphere         struct {
+	IntraWebhook struct {
+		RequireSignature bool   `json:"requireSignature"`
+		SignatureHeader  string `json:"signatureHeader"`
+	} `json:"intraWebhook"`
+	CampusDomain             string `json:"campusDomain"`
+	BatmanEndpoint           string `json:"batmanEndpoint"`
+	BatmanMaxAttempts        int    `json:"batmanMaxAttempts"`
+	BatmanRetryDelay         int    `json:"batmanRetryDelay"`
+	BatmanMaxRetryDelay      int    `json:"batmanMaxRetryDelay"`
+	ReconcileIntervalMinutes int    `json:"reconcileIntervalMinutes"`
+	Vogsphere                struct {
 		Address        string `json:"address"`
 		Port           int    `json:"port"`
 		User           string `json:"user"`
 		PrivateKeyPath string `json:"privateKeyPath"`
 		Path           string `json:"path"`
+		// Single commits adding at least this many lines are flagged as dumps
+		DumpInsertions int `json:"dumpInsertions"`
 	} `json:"vogsphere"`
+	// Reports that don't meet these rules aren't posted on their own
+	Reporting struct {
+		MinMatches       int      `json:"minMatches"`
+		MinMatchedLogins int      `json:"minMatchedLogins"`
+		IncludeProjects  []string `json:"includeProjects"`
+		ExcludeProjects  []string `json:"excludeProjects"`
+		HoldClean        bool     `json:"holdClean"`
+		Digest           bool     `json:"digest"`
+		DigestTime       string   `json:"digestTime"`
+	} `json:"reporting"`
 	Slack struct {
-		Channel                string `json:"channel"`
+		Channel string `json:"channel"`
+		// First match wins; reports matching no route go to Channel
+		Routes []struct {
+			Cursus  string `json:"cursus"`
+			Project string `json:"project"`
+			Channel string `json:"channel"`
+		} `json:"routes"`
 		InteractiveCloseReason string `json:"interactiveCloseReason"`
+		MaxAttempts            int    `json:"maxAttempts"`
+		// Slack user IDs or user group IDs mapped to the actions they may take ("*" for all)
+		Authorization struct {
+			Users  map[string][]string `json:"users"`
+			Groups map[string][]string `json:"groups"`
+		} `json:"authorization"`
 	} `json:"slack"`
 }
 
@@ -40,6 +73,7 @@ var config Config
 
 func init() {
 	intra.SetCacheTimeout(120)
+	rand.Seed(time.Now().UnixNano())
 }
 
 func outputErr(err error, fatal bool) {
@@ -69,13 +103,27 @@ func main() {
 	if err := openDatabaseConnection(); err != nil {
 		outputErr(err, true)
 	}
+	slackClient = newSlackAPI(os.Getenv("SLACK_TOKEN"))
+	if config.DryRun {
+		log.Println("dry run: Intra mutations will be logged, not performed")
+		intraWrites = dryRunIntraWriter{}
+	}
+	startedAt := time.Now()
 	rq := &reportQueue{
 		in:  make(chan *teamReport),
 		out: make(chan *teamReport),
 	}
-	iq := make(interactQueue)
+	iq := &interactQueue{
+		in:      make(chan *Interaction),
+		reports: rq,
+	}
 	go rq.processInput()
 	go rq.processOutput()
 	go iq.processInput()
+	go rq.resume(startedAt)
+	go runLockExpiry()
+	go runReconciler()
+	go runDigest()
+	go backfillLogins()
 	listen(rq, iq)
 }
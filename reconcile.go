@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stephen-gardner/intra"
+)
+
+const intraCloseActive = "close"
+
+// Returns the user's active close in Intra, if any, that Sibyl didn't create; a lock made through
+// any of the user's other teams is still Sibyl's own
+func findExternalClose(user *TeamRecordUser) (*intra.UserClose, error) {
+	closes := intra.UserCloses{}
+	if err := closes.GetForUser(context.Background(), true, user.UserID, nil); err != nil {
+		return nil, err
+	}
+	closeIDs, err := getSibylCloseIDs(user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	sibylCloses := make(map[int]bool)
+	for _, closeID := range closeIDs {
+		sibylCloses[closeID] = true
+	}
+	for i := range closes {
+		userClose := &closes[i]
+		if userClose.State != intraCloseActive || sibylCloses[userClose.ID] {
+			continue
+		}
+		return userClose, nil
+	}
+	return nil, nil
+}
+
+// Brings one user's lock state in line with Intra, returning a description of any drift found
+func reconcileUser(rec *TeamRecord, user *TeamRecordUser) ([]string, error) {
+	drift := make([]string, 0)
+	if user.CloseID != nil && !isDryRunCloseID(*user.CloseID) {
+		userClose := &intra.UserClose{ID: *user.CloseID}
+		err := userClose.Get(context.Background(), true)
+		if err != nil && !isIntraNotFound(err) {
+			return drift, err
+		}
+		if err != nil || userClose.State != intraCloseActive {
+			userClose.User.ID = user.UserID
+			if err := rec.removeClose(userClose); err != nil {
+				return drift, err
+			}
+			drift = append(drift, fmt.Sprintf("%s was unlocked in Intra outside of Sibyl (close %d)", user.Login, userClose.ID))
+		}
+	}
+	external, err := findExternalClose(user)
+	if err != nil {
+		return drift, err
+	}
+	// Only mention closes made elsewhere once, when they first show up or go away
+	switch {
+	case external != nil && (user.ExternalCloseID == nil || *user.ExternalCloseID != external.ID):
+		closeID := external.ID
+		if err := user.setExternalClose(&closeID); err != nil {
+			return drift, err
+		}
+		drift = append(drift, fmt.Sprintf("%s was closed in Intra outside of Sibyl (close %d: %s)", user.Login, external.ID, external.Reason))
+	case external == nil && user.ExternalCloseID != nil:
+		closeID := *user.ExternalCloseID
+		if err := user.setExternalClose(nil); err != nil {
+			return drift, err
+		}
+		drift = append(drift, fmt.Sprintf("%s's close made outside of Sibyl has been lifted (close %d)", user.Login, closeID))
+	}
+	return drift, nil
+}
+
+// Holds the team for the whole pass, so a close Sibyl is making or lifting at the same time can't
+// be mistaken for drift
+func reconcileTeam(teamID int) error {
+	defer teamLocks.lock(teamID)()
+	rec := &TeamRecord{}
+	if err := rec.get(teamID); err != nil {
+		return err
+	}
+	drift := make([]string, 0)
+	var err error
+	for _, user := range rec.getUsers() {
+		var userDrift []string
+		userDrift, err = reconcileUser(rec, user)
+		drift = append(drift, userDrift...)
+		if err != nil {
+			// Drift already corrected won't turn up again on the next pass, so it's reported regardless
+			break
+		}
+	}
+	if len(drift) > 0 {
+		if err := rec.updateReportMessage(); err != nil {
+			outputErr(err, false)
+		}
+		msg := ":mag: Sibyl's records had drifted from Intra:\n• " + strings.Join(drift, "\n• ")
+		if err := rec.postNotice(msg); err != nil {
+			outputErr(err, false)
+		}
+	}
+	return err
+}
+
+// Periodically checks every close Sibyl knows about against Intra
+func runReconciler() {
+	if config.ReconcileIntervalMinutes <= 0 {
+		return
+	}
+	for range time.Tick(time.Duration(config.ReconcileIntervalMinutes) * time.Minute) {
+		teamIDs, err := getModeratedTeamIDs()
+		if err != nil {
+			outputErr(err, false)
+			continue
+		}
+		for _, teamID := range teamIDs {
+			if err := reconcileTeam(teamID); err != nil {
+				outputErr(err, false)
+			}
+		}
+	}
+}
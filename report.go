@@ -2,7 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math/rand"
+	"path"
 	"strings"
 	"time"
 
@@ -11,32 +16,35 @@ import (
 
 type (
 	teamReportUser struct {
-		name    string
-		login   string
-		photo   string
-		attempt int
+		userID        int
+		name          string
+		login         string
+		photo         string
+		attempt       int
+		priorOffenses int
 	}
 	teamReport struct {
-		deliveryID     string
-		teamID         int
-		batmanAttempts int
-		name           string
-		leader         string
-		projectSlug    string
-		finalMark      int
-		users          []teamReportUser
-		repo           struct {
-			url        string
-			uuid       string
-			status     string
-			matches    string
-			commits    int
-			lastUpdate time.Time
+		job         *ReportJob
+		deliveryID  string
+		teamID      int
+		cursus      string
+		name        string
+		leader      string
+		projectSlug string
+		finalMark   int
+		users       []teamReportUser
+		repo        struct {
+			url     string
+			uuid    string
+			status  string
+			matches string
+			history *repoHistory
 		}
 		createdAt     time.Time
 		closedAt      time.Time
 		teamCancelled bool
 		passed        bool
+		blocks        string
 	}
 	reportQueue struct {
 		in  chan *teamReport
@@ -81,6 +89,7 @@ func (report *teamReport) loadData(ctx context.Context, deliveryID string, wt *i
 			cursusName = "?"
 		}
 	}
+	report.cursus = cursusName
 	report.name = fmt.Sprintf("[%s] _%s_", cursusName, wt.Name)
 	report.projectSlug = wt.Project.Slug
 	report.finalMark = wt.FinalMark
@@ -90,6 +99,7 @@ func (report *teamReport) loadData(ctx context.Context, deliveryID string, wt *i
 		for _, iUser := range it.Users {
 			if iUser.Login == user.Login {
 				report.users = append(report.users, teamReportUser{
+					userID:  iUser.ID,
 					name:    user.UsualFullName,
 					login:   user.Login,
 					photo:   user.ImageURL,
@@ -110,18 +120,31 @@ func (report *teamReport) loadData(ctx context.Context, deliveryID string, wt *i
 	return nil
 }
 
+// Inspects the team's repo once; the match labels and the report's forensics both work from it
+func (report *teamReport) loadHistory() error {
+	if report.repo.history != nil || !strings.Contains(report.repo.url, config.CampusDomain) {
+		return nil
+	}
+	vog := vogConn{}
+	if err := vog.connect(); err != nil {
+		return err
+	}
+	defer vog.Close()
+	history, err := vog.getGitRepo(report.repo.url, report.repo.uuid).inspect(report.closedAt)
+	if err != nil {
+		return err
+	}
+	report.repo.history = history
+	return nil
+}
+
 func (report *teamReport) generate() (blocks string, err error) {
-	if strings.Contains(report.repo.url, config.CampusDomain) {
-		vog := vogConn{}
-		if err = vog.connect(); err != nil {
-			return
-		}
-		defer vog.Close()
-		repo := vog.getGitRepo(report.repo.url, report.repo.uuid)
-		if report.repo.lastUpdate, err = repo.getLastUpdate(); err != nil {
-			return
-		}
-		if report.repo.commits, err = repo.countCommits(); err != nil {
+	if err = report.loadHistory(); err != nil {
+		return
+	}
+	for i := range report.users {
+		user := &report.users[i]
+		if user.priorOffenses, err = countPriorOffenses(user.userID, user.login, report.teamID); err != nil {
 			return
 		}
 	}
@@ -129,45 +152,353 @@ func (report *teamReport) generate() (blocks string, err error) {
 	return
 }
 
+func (job *ReportJob) getTeam() (*intra.WebTeam, error) {
+	team := &intra.WebTeam{}
+	if err := json.Unmarshal([]byte(job.Payload), team); err != nil {
+		return nil, err
+	}
+	return team, nil
+}
+
+// Rebuilds a report from the webhook payload stored with its job
+func (job *ReportJob) restore(ctx context.Context) (*teamReport, error) {
+	team, err := job.getTeam()
+	if err != nil {
+		return nil, err
+	}
+	report := &teamReport{}
+	if err := report.loadData(ctx, job.DeliveryID, team); err != nil {
+		return nil, err
+	}
+	report.job = job
+	report.repo.status = job.BatmanStatus
+	report.repo.matches = job.Matches
+	return report, nil
+}
+
+// Requeues reports that were marked but never made it to Slack before the last shutdown
+func (queue *reportQueue) resume(startedAt time.Time) {
+	if dead, err := getDeadLetterJobs(); err != nil {
+		outputErr(err, false)
+	} else if len(dead) > 0 {
+		ids := make([]string, len(dead))
+		for i, job := range dead {
+			ids[i] = fmt.Sprintf("%d (%s)", job.ID, job.State)
+		}
+		log.Printf("%d report jobs in dead-letter: %s\n", len(dead), strings.Join(ids, ", "))
+	}
+	jobs, err := getUnfinishedJobs(startedAt)
+	if err != nil {
+		outputErr(err, false)
+		return
+	}
+	for i := range jobs {
+		job := &jobs[i]
+		// Nothing will ever make a corrupt payload load, but Intra being unavailable is worth waiting out
+		if _, err := job.getTeam(); err != nil {
+			outputErr(fmt.Errorf("unable to resume job %d: %s", job.ID, err.Error()), false)
+			if err := job.setState(jobFailed); err != nil {
+				outputErr(err, false)
+			}
+			continue
+		}
+		queue.resumeJob(job, 1)
+	}
+}
+
+// Enough to ride out an Intra outage at startup without retrying a team that's gone for good forever
+const resumeMaxAttempts = 10
+
+// Intra won't redeliver a webhook it got a 200 for, so the job stays pending until its data loads
+func (queue *reportQueue) resumeJob(job *ReportJob, attempt int) {
+	report, err := job.restore(context.Background())
+	if err != nil && attempt >= resumeMaxAttempts {
+		outputErr(fmt.Errorf("giving up on resuming job %d after %d attempts: %s", job.ID, attempt, err.Error()), false)
+		job.LastError = err.Error()
+		if err := job.setState(jobFailed); err != nil {
+			outputErr(err, false)
+		}
+		return
+	}
+	if err != nil {
+		delay := batmanBackoff(attempt)
+		outputErr(fmt.Errorf("unable to resume job %d, retrying in %s: %s", job.ID, delay, err.Error()), false)
+		time.AfterFunc(delay, func() {
+			queue.resumeJob(job, attempt+1)
+		})
+		return
+	}
+	if job.State == jobPendingSlack {
+		queue.out <- report
+	} else if job.NextAttemptAt != nil && job.NextAttemptAt.After(time.Now()) {
+		queue.retryBatman(report, time.Until(*job.NextAttemptAt))
+	} else {
+		queue.in <- report
+	}
+}
+
+// Exponential backoff with jitter so a Batman outage isn't met with a wall of retries
+func batmanBackoff(attempt int) time.Duration {
+	delay := time.Duration(config.BatmanRetryDelay) * time.Second
+	limit := time.Duration(config.BatmanMaxRetryDelay) * time.Second
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func (queue *reportQueue) retryBatman(report *teamReport, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		queue.in <- report
+	})
+}
+
+var errJobNotDead = errors.New("report job is not in dead-letter")
+
+// Gives a dead-lettered report a fresh set of attempts at whichever step it gave up on
+func (queue *reportQueue) requeue(job *ReportJob) error {
+	if job.State != jobDeadBatman && job.State != jobDeadSlack {
+		return errJobNotDead
+	}
+	report, err := job.restore(context.Background())
+	if err != nil {
+		return err
+	}
+	revived, err := job.revive()
+	if err != nil {
+		return err
+	}
+	if !revived {
+		return errJobNotDead
+	}
+	go func(queue *reportQueue, report *teamReport) {
+		if report.job.State == jobPendingSlack {
+			queue.out <- report
+		} else {
+			queue.in <- report
+		}
+	}(queue, report)
+	return nil
+}
+
+// Parks a report that exhausted its Batman attempts until someone asks for it to be re-run
+func (queue *reportQueue) deadLetterBatman(report *teamReport) {
+	report.job.NextAttemptAt = nil
+	if err := report.job.setState(jobDeadBatman); err != nil {
+		outputErr(err, false)
+	}
+	blocks, err := composeDeadLetterBlocks(report)
+	if err == nil {
+		_, err = slackClient.postMessage(report.getChannel(), "", blocks, "")
+	}
+	if err != nil {
+		outputErr(err, false)
+	}
+}
+
 func (queue *reportQueue) processInput() {
 	// Batman doesn't handle concurrent requests so well
 	for report := range queue.in {
-		report.batmanAttempts++
+		report.job.BatmanAttempts++
 		status, res, err := runBatman(report.leader, report.projectSlug, report.repo.url)
 		if err != nil {
 			outputErr(err, false)
 		}
-		if status == batmanError && report.batmanAttempts < config.BatmanMaxAttempts {
-			go func(queue *reportQueue, report *teamReport) {
-				queue.in <- report
-			}(queue, report)
+		if status == batmanError {
+			if report.job.BatmanAttempts >= config.BatmanMaxAttempts {
+				queue.deadLetterBatman(report)
+				continue
+			}
+			delay := batmanBackoff(report.job.BatmanAttempts)
+			next := time.Now().Add(delay)
+			report.job.NextAttemptAt = &next
+			if err := report.job.save(); err != nil {
+				outputErr(err, false)
+			}
+			queue.retryBatman(report, delay)
 			continue
 		}
 		report.repo.status = status
 		if res != nil {
-			report.repo.matches = res.getFormattedOutput()
+			var firstCommit time.Time
+			if err := report.loadHistory(); err != nil {
+				// Matches are still worth posting without knowing who came first
+				outputErr(err, false)
+			} else if report.repo.history != nil {
+				firstCommit = report.repo.history.firstCommit
+			}
+			report.repo.matches = res.getFormattedOutput(firstCommit)
+			report.job.MatchCount = res.getSize()
+			report.job.MatchedLogins = len(res.getMatchedLogins())
+			if err := saveCodeMatches(report.teamID, res.getCodeMatches(report.teamID, report.projectSlug)); err != nil {
+				outputErr(err, false)
+			}
+		}
+		report.job.NextAttemptAt = nil
+		report.job.BatmanStatus = report.repo.status
+		report.job.Matches = report.repo.matches
+		if err := report.job.setState(jobPendingSlack); err != nil {
+			outputErr(err, false)
 		}
 		queue.out <- report
 	}
 }
 
+const (
+	routePost = iota
+	routeHold
+	routeDrop
+)
+
+func matchesProject(patterns []string, slug string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, slug); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks the channel for the report's cursus and project from the configured routes
+func (report *teamReport) getChannel() string {
+	for _, route := range config.Slack.Routes {
+		if route.Cursus != "" && route.Cursus != report.cursus {
+			continue
+		}
+		if route.Project != "" && !matchesProject([]string{route.Project}, report.projectSlug) {
+			continue
+		}
+		return route.Channel
+	}
+	return config.Slack.Channel
+}
+
+// Decides whether a report is worth interrupting reviewers for; Batman errors always are
+func (report *teamReport) route() int {
+	rules := config.Reporting
+	if len(rules.IncludeProjects) > 0 && !matchesProject(rules.IncludeProjects, report.projectSlug) {
+		return routeDrop
+	}
+	if matchesProject(rules.ExcludeProjects, report.projectSlug) {
+		return routeDrop
+	}
+	switch report.repo.status {
+	case batmanError:
+		return routePost
+	case batmanClean, batmanEmpty, batmanNotApplicable:
+		if rules.HoldClean {
+			return routeHold
+		}
+		return routePost
+	}
+	if report.job.MatchCount < rules.MinMatches || report.job.MatchedLogins < rules.MinMatchedLogins {
+		return routeHold
+	}
+	return routePost
+}
+
+// Posts the report and threads its matches underneath; a retry picks up after the last step that succeeded
+func (report *teamReport) post(channel string) error {
+	if report.blocks == "" {
+		blocks, err := report.generate()
+		if err != nil {
+			return err
+		}
+		report.blocks = blocks
+	}
+	if report.job.SlackTS == "" {
+		ts, err := slackClient.postMessage(channel, "", report.blocks, "")
+		if err != nil {
+			return err
+		}
+		report.job.SlackChannel = channel
+		report.job.SlackTS = ts
+		if err := report.job.save(); err != nil {
+			return err
+		}
+	}
+	rec := &TeamRecord{}
+	if err := rec.get(report.teamID); err != nil {
+		return err
+	}
+	if err := rec.setSlackMessage(report.job.SlackChannel, report.job.SlackTS, report.blocks); err != nil {
+		return err
+	}
+	if report.repo.matches == "" {
+		return nil
+	}
+	return slackClient.upload(report.job.SlackChannel, report.job.SlackTS, "Matches", report.repo.matches)
+}
+
+// Requeues a report that failed to post, unless Slack says it never will or we've run out of attempts
+func (queue *reportQueue) retrySlack(report *teamReport, err error) {
+	report.job.SlackAttempts++
+	report.job.LastError = err.Error()
+	// Generating the report also depends on Vogsphere and the database, which need time to recover
+	// just as much as Slack does
+	delay := batmanBackoff(report.job.SlackAttempts)
+	slackErr, isSlackErr := err.(*slackError)
+	if isSlackErr && slackErr.retryAfter > 0 {
+		delay = slackErr.retryAfter
+	}
+	if (isSlackErr && !slackErr.temporary()) || report.job.SlackAttempts >= config.Slack.MaxAttempts {
+		log.Printf("report job %d moved to dead-letter after %d posting attempts: %s\n",
+			report.job.ID,
+			report.job.SlackAttempts,
+			report.job.LastError,
+		)
+		if err := report.job.setState(jobDeadSlack); err != nil {
+			outputErr(err, false)
+		}
+		// The report's own channel may be the problem, so the notice goes to the default one
+		blocks, err := composeDeadLetterBlocks(report)
+		if err == nil {
+			_, err = slackClient.postMessage(config.Slack.Channel, "", blocks, "")
+		}
+		if err != nil {
+			outputErr(err, false)
+		}
+		return
+	}
+	if err := report.job.save(); err != nil {
+		outputErr(err, false)
+	}
+	time.AfterFunc(delay, func() {
+		queue.out <- report
+	})
+}
+
 func (queue *reportQueue) processOutput() {
-	slack := getSlack()
 	// Slack rate limits files.upload to 20 requests/min
 	slackThrottle := time.Tick(time.Minute / 20)
 	for report := range queue.out {
-		<-slackThrottle
-		blocks, err := report.generate()
-		if err == nil {
-			if err = slack.postMessage("", blocks, ""); err == nil && report.repo.matches != "" {
-				err = slack.uploadMatches(report.repo.matches)
+		channel := report.getChannel()
+		if route := report.route(); route != routePost {
+			report.job.SlackChannel = channel
+			state := jobSuppressed
+			if route == routeHold && config.Reporting.Digest {
+				state = jobHeldForDigest
+			}
+			if err := report.job.setState(state); err != nil {
+				outputErr(err, false)
 			}
+			continue
 		}
+		<-slackThrottle
+		err := report.post(channel)
 		if err != nil {
 			outputErr(err, false)
-			go func(queue *reportQueue, report *teamReport) {
-				queue.out <- report
-			}(queue, report)
+			queue.retrySlack(report, err)
+			continue
+		}
+		if err := report.job.setState(jobPosted); err != nil {
+			outputErr(err, false)
 		}
 	}
 }
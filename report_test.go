@@ -0,0 +1,156 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stephen-gardner/intra"
+)
+
+func TestProcessOutputThreadsMatchesUnderReport(t *testing.T) {
+	fake := setupTest(t)
+	teamID := createTestTeam(t, "alice", "bob")
+	team := &intra.WebTeam{ID: teamID}
+	team.Project.Slug = "libft"
+	job := &ReportJob{}
+	if err := job.create("", team, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	report := &teamReport{
+		job:         job,
+		teamID:      teamID,
+		name:        "[42] _test_",
+		projectSlug: "libft",
+		users:       []teamReportUser{{login: "alice"}, {login: "bob"}},
+	}
+	report.repo.url = batmanNotApplicable
+	report.repo.status = "2 matches"
+	report.repo.matches = "carol [01 Jan 20 00:00 UTC] (likely source)"
+
+	queue := &reportQueue{out: make(chan *teamReport)}
+	done := make(chan struct{})
+	go func() {
+		queue.processOutput()
+		close(done)
+	}()
+	queue.out <- report
+	close(queue.out)
+	<-done
+
+	posts := fake.callsTo("chat.postMessage")
+	if len(posts) != 1 || posts[0].channel != "CREPORTS" || posts[0].threadTS != "" {
+		t.Fatalf("expected one top-level report in CREPORTS, got %+v", posts)
+	}
+	uploads := fake.callsTo("files.upload")
+	if len(uploads) != 1 || uploads[0].threadTS != posts[0].ts {
+		t.Fatalf("expected matches threaded under %s, got %+v", posts[0].ts, uploads)
+	}
+	saved := &ReportJob{}
+	if err := saved.get(job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if saved.State != jobPosted || saved.SlackTS != posts[0].ts {
+		t.Errorf("job not recorded as posted at %s: %s %s", posts[0].ts, saved.State, saved.SlackTS)
+	}
+	rec := &TeamRecord{}
+	if err := rec.get(teamID); err != nil {
+		t.Fatal(err)
+	}
+	if rec.SlackTS != posts[0].ts || rec.ReportBlocks == "" {
+		t.Errorf("team record doesn't point at the report: %q", rec.SlackTS)
+	}
+}
+
+func TestBatmanBackoff(t *testing.T) {
+	saveConfig(t)
+	config.BatmanRetryDelay = 10
+	config.BatmanMaxRetryDelay = 60
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{1, 5 * time.Second, 10 * time.Second},
+		{2, 10 * time.Second, 20 * time.Second},
+		{3, 20 * time.Second, 40 * time.Second},
+		{10, 30 * time.Second, 60 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			if delay := batmanBackoff(test.attempt); delay < test.min || delay > test.max {
+				t.Errorf("attempt %d: %s not within [%s, %s]", test.attempt, delay, test.min, test.max)
+			}
+		}
+	}
+	config.BatmanRetryDelay = 0
+	if delay := batmanBackoff(3); delay != 0 {
+		t.Errorf("expected no delay when unconfigured, got %s", delay)
+	}
+}
+
+func TestGetChannel(t *testing.T) {
+	saveConfig(t)
+	config.Slack.Channel = "CDEFAULT"
+	config.Slack.Routes = []struct {
+		Cursus  string `json:"cursus"`
+		Project string `json:"project"`
+		Channel string `json:"channel"`
+	}{
+		{Cursus: "C Piscine", Channel: "CPISCINE"},
+		{Cursus: "42", Project: "piscine-*", Channel: "CPISCINE"},
+		{Project: "ft_*", Channel: "CFT"},
+	}
+	tests := []struct {
+		cursus, project, channel string
+	}{
+		{"C Piscine", "c-piscine-shell-00", "CPISCINE"},
+		{"42", "piscine-reloaded", "CPISCINE"},
+		{"42", "ft_printf", "CFT"},
+		{"42cursus", "ft_ls", "CFT"},
+		{"42cursus", "libft", "CDEFAULT"},
+	}
+	for _, test := range tests {
+		report := &teamReport{cursus: test.cursus, projectSlug: test.project}
+		if channel := report.getChannel(); channel != test.channel {
+			t.Errorf("%s/%s routed to %s, expected %s", test.cursus, test.project, channel, test.channel)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	saveConfig(t)
+	config.Reporting.MinMatches = 3
+	config.Reporting.MinMatchedLogins = 1
+	config.Reporting.ExcludeProjects = []string{"exam-*"}
+	config.Reporting.HoldClean = true
+	tests := []struct {
+		name          string
+		project       string
+		status        string
+		matches       int
+		matchedLogins int
+		route         int
+	}{
+		{"excluded project", "exam-rank-02", "5 matches", 5, 2, routeDrop},
+		{"batman error", "libft", batmanError, 0, 0, routePost},
+		{"clean", "libft", batmanClean, 0, 0, routeHold},
+		{"too few matches", "libft", "2 matches", 2, 1, routeHold},
+		{"no other students", "libft", "5 matches", 5, 0, routeHold},
+		{"worth a report", "libft", "5 matches", 5, 1, routePost},
+	}
+	for _, test := range tests {
+		report := &teamReport{
+			projectSlug: test.project,
+			job:         &ReportJob{MatchCount: test.matches, MatchedLogins: test.matchedLogins},
+		}
+		report.repo.status = test.status
+		if route := report.route(); route != test.route {
+			t.Errorf("%s: routed %d, expected %d", test.name, route, test.route)
+		}
+	}
+	config.Reporting.IncludeProjects = []string{"ft_*"}
+	report := &teamReport{projectSlug: "libft", job: &ReportJob{}}
+	report.repo.status = batmanError
+	if route := report.route(); route != routeDrop {
+		t.Errorf("project outside includeProjects routed %d", route)
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/stephen-gardner/intra"
 )
@@ -20,7 +24,7 @@ func (queue *reportQueue) handleTeamMarked(w http.ResponseWriter, r *http.Reques
 		w.WriteHeader(http.StatusNotImplemented)
 		return
 	}
-	if r.Header.Get("X-Secret") != os.Getenv("X_SECRET") {
+	if !verifyIntraSecret(r.Header) {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -31,6 +35,10 @@ func (queue *reportQueue) handleTeamMarked(w http.ResponseWriter, r *http.Reques
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !verifyIntraSignature(r.Header, data) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	team := &intra.WebTeam{}
 	if err := json.Unmarshal(data, &team); err != nil {
 		err = fmt.Errorf("[400] %s: %s", err.Error(), string(data))
@@ -38,9 +46,23 @@ func (queue *reportQueue) handleTeamMarked(w http.ResponseWriter, r *http.Reques
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	report := &teamReport{}
+	job, err := acceptDelivery(deliveryID, team, data)
+	if err != nil {
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		// Already seen; acknowledge so Intra stops retrying
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	report := &teamReport{job: job}
 	if err := report.loadData(r.Context(), deliveryID, team); err != nil {
 		outputErr(err, false)
+		if err := job.setState(jobFailed); err != nil {
+			outputErr(err, false)
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -50,39 +72,140 @@ func (queue *reportQueue) handleTeamMarked(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusOK)
 }
 
-func verifySignature(header http.Header, body string) (bool, error) {
-	signature, err := hex.DecodeString(strings.TrimPrefix(header.Get("X-Slack-Signature"), "v0="))
+// Secrets are comma-separated so a new one can be rolled out before the old one is retired
+func getSecrets(env string) []string {
+	secrets := make([]string, 0)
+	for _, secret := range strings.Split(os.Getenv(env), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+func verifyIntraSecret(header http.Header) bool {
+	provided := []byte(header.Get("X-Secret"))
+	valid := 0
+	for _, secret := range getSecrets("X_SECRET") {
+		valid |= subtle.ConstantTimeCompare(provided, []byte(secret))
+	}
+	return valid == 1
+}
+
+// When enabled, the body must also carry an HMAC-SHA256 signature so a leaked X-Secret alone isn't enough
+func verifyIntraSignature(header http.Header, body []byte) bool {
+	if !config.IntraWebhook.RequireSignature {
+		return true
+	}
+	provided := strings.TrimPrefix(header.Get(config.IntraWebhook.SignatureHeader), "sha256=")
+	signature, err := hex.DecodeString(provided)
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	valid := false
+	for _, secret := range getSecrets("X_SIGNING_SECRET") {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+var deliveryLock sync.Mutex
+
+// Records a new job for the delivery, or returns nil if it has already been accepted
+func acceptDelivery(deliveryID string, team *intra.WebTeam, data []byte) (*ReportJob, error) {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	duplicate, err := isDuplicateDelivery(deliveryID, team.ID, team.FinalMark)
+	if err != nil || duplicate {
+		return nil, err
+	}
+	job := &ReportJob{}
+	if err := job.create(deliveryID, team, data); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+type replayCache struct {
+	sync.Mutex
+	seen map[string]time.Time
+}
+
+// Slack recommends rejecting requests signed more than five minutes ago
+const slackRequestWindow = 5 * time.Minute
+
+var seenSlackRequests = &replayCache{seen: make(map[string]time.Time)}
+
+// Returns false if the key has already been seen within the request window
+func (cache *replayCache) add(key string) bool {
+	cache.Lock()
+	defer cache.Unlock()
+	now := time.Now()
+	for seenKey, seenAt := range cache.seen {
+		if now.Sub(seenAt) > slackRequestWindow {
+			delete(cache.seen, seenKey)
+		}
+	}
+	if _, present := cache.seen[key]; present {
+		return false
+	}
+	cache.seen[key] = now
+	return true
+}
+
+// Validates the request's signature and freshness; each signature is only accepted once
+func verifySignature(header http.Header, body string) bool {
+	signatureHeader := header.Get("X-Slack-Signature")
+	if !strings.HasPrefix(signatureHeader, "v0=") {
+		return false
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(signatureHeader, "v0="))
 	if err != nil {
-		return false, err
+		return false
 	}
 	timestamp := header.Get("X-Slack-Request-Timestamp")
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(secs, 0))
+	if age > slackRequestWindow || age < -slackRequestWindow {
+		return false
+	}
 	mac := hmac.New(sha256.New, []byte(os.Getenv("SLACK_SIGNING_SECRET")))
 	mac.Write([]byte(fmt.Sprintf("v0:%s:%s", timestamp, body)))
-	return hmac.Equal(signature, mac.Sum(nil)), nil
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return false
+	}
+	return seenSlackRequests.add("signature:" + signatureHeader)
 }
 
-func (queue interactQueue) handleInteraction(w http.ResponseWriter, r *http.Request) {
+func (queue *interactQueue) handleInteraction(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusNotImplemented)
 		return
 	}
 	body, err := ioutil.ReadAll(r.Body)
-	if err == nil {
-		valid := false
-		if valid, err = verifySignature(r.Header, string(body)); err == nil {
-			if !valid {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			err = r.ParseForm()
-		}
-	}
 	if err != nil {
 		outputErr(err, false)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !verifySignature(r.Header, string(body)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	if err := r.ParseForm(); err != nil {
+		err = fmt.Errorf("[400] %s: %s", err.Error(), string(body))
+		outputErr(err, false)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 	payload := &Interaction{}
 	data := []byte(r.Form.Get("payload"))
 	if err := json.Unmarshal(data, payload); err != nil {
@@ -91,18 +214,185 @@ func (queue interactQueue) handleInteraction(w http.ResponseWriter, r *http.Requ
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if payload.Type != "block_actions" || len(payload.Actions) == 0 || payload.Actions[0].ActionID != "manage_report" {
+	if payload.TriggerID != "" && !seenSlackRequests.add("trigger:"+payload.TriggerID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch payload.Type {
+	case "block_actions":
+		if len(payload.Actions) == 0 {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		switch payload.Actions[0].ActionID {
+		case "manage_report", "manage_user", "rerun_batman", "repost_report":
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		// The trigger ID expires long before a queued click would get its turn
+		if action, _, _ := payload.getAction(); needsModerationInput(action) {
+			allowed, err := payload.authorize()
+			if err == nil && allowed {
+				err = payload.openModerationModal()
+			}
+			if err != nil {
+				outputErr(err, false)
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	case "view_submission":
+		if payload.View.CallbackID != "moderation_reason" {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		// Slack keeps the modal open and shows these next to the offending inputs
+		if errs := payload.loadSubmission(); errs != nil {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"response_action": "errors",
+				"errors":          errs,
+			})
+			return
+		}
+	default:
 		w.WriteHeader(http.StatusNotImplemented)
 		return
 	}
-	go func(queue interactQueue, payload *Interaction) {
-		queue <- payload
+	go func(queue *interactQueue, payload *Interaction) {
+		queue.in <- payload
 	}(queue, payload)
 	w.WriteHeader(http.StatusOK)
 }
 
-func listen(rq *reportQueue, iq interactQueue) {
+// Staff tooling authenticates with a bearer token shared through the API_TOKEN env var
+func verifyAPIToken(r *http.Request) bool {
+	token := os.Getenv("API_TOKEN")
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if !verifyAPIToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var events []AuditEvent
+	var err error
+	query := r.URL.Query()
+	if team := query.Get("team"); team != "" {
+		teamID, convErr := strconv.Atoi(team)
+		if convErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events, err = getAuditEventsForTeam(teamID)
+	} else if actor := query.Get("actor"); actor != "" {
+		events, err = getAuditEventsForActor(actor)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		outputErr(err, false)
+	}
+}
+
+// Lists reports that gave up on Batman or Slack and are waiting on a human
+func handleDeadLetterJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if !verifyAPIToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	jobs, err := getDeadLetterJobs()
+	if err != nil {
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	type deadLetterJob struct {
+		ID             uint      `json:"id"`
+		TeamID         int       `json:"team_id"`
+		ProjectSlug    string    `json:"project_slug"`
+		State          string    `json:"state"`
+		BatmanAttempts int       `json:"batman_attempts"`
+		SlackAttempts  int       `json:"slack_attempts"`
+		LastError      string    `json:"last_error"`
+		UpdatedAt      time.Time `json:"updated_at"`
+	}
+	dead := make([]deadLetterJob, len(jobs))
+	for i, job := range jobs {
+		dead[i] = deadLetterJob{
+			ID:             job.ID,
+			TeamID:         job.TeamID,
+			ProjectSlug:    job.ProjectSlug,
+			State:          job.State,
+			BatmanAttempts: job.BatmanAttempts,
+			SlackAttempts:  job.SlackAttempts,
+			LastError:      job.LastError,
+			UpdatedAt:      job.UpdatedAt,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dead); err != nil {
+		outputErr(err, false)
+	}
+}
+
+// Requeues a dead-lettered report, the same as its Slack button would
+func (queue *reportQueue) handleRequeueJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if !verifyAPIToken(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	jobID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	job := &ReportJob{}
+	if err := job.get(uint(jobID)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := queue.requeue(job); err != nil {
+		if err == errJobNotDead {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func listen(rq *reportQueue, iq *interactQueue) {
 	http.HandleFunc("/sibyl/slack", iq.handleInteraction)
+	http.HandleFunc("/sibyl/command", handleSlashCommand)
+	http.HandleFunc("/sibyl/audit", handleAuditLog)
+	http.HandleFunc("/sibyl/graph", handleMatchGraph)
+	http.HandleFunc("/sibyl/jobs/dead", handleDeadLetterJobs)
+	http.HandleFunc("/sibyl/jobs/requeue", rq.handleRequeueJob)
 	http.HandleFunc("/sibyl/teams/marked", rq.handleTeamMarked)
 	// Display picture for anonymized accounts
 	http.HandleFunc("/3b3.jpg", func(writer http.ResponseWriter, request *http.Request) {
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signSlackRequest(secret, body string, at time.Time) http.Header {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("v0:%s:%s", timestamp, body)))
+	header := http.Header{}
+	header.Set("X-Slack-Request-Timestamp", timestamp)
+	header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func TestVerifySignature(t *testing.T) {
+	saved := os.Getenv("SLACK_SIGNING_SECRET")
+	os.Setenv("SLACK_SIGNING_SECRET", "shhh")
+	t.Cleanup(func() {
+		os.Setenv("SLACK_SIGNING_SECRET", saved)
+	})
+	body := fmt.Sprintf("payload=test-%d", time.Now().UnixNano())
+	header := signSlackRequest("shhh", body, time.Now())
+	if !verifySignature(header, body) {
+		t.Fatal("valid request rejected")
+	}
+	if verifySignature(header, body) {
+		t.Error("replayed request accepted")
+	}
+	if verifySignature(signSlackRequest("shhh", body+"x", time.Now()), body) {
+		t.Error("tampered body accepted")
+	}
+	if verifySignature(signSlackRequest("wrong", body+"1", time.Now()), body+"1") {
+		t.Error("request signed with the wrong secret accepted")
+	}
+	if verifySignature(signSlackRequest("shhh", body+"2", time.Now().Add(-10*time.Minute)), body+"2") {
+		t.Error("stale request accepted")
+	}
+	header = signSlackRequest("shhh", body+"3", time.Now())
+	header.Set("X-Slack-Signature", "v1="+header.Get("X-Slack-Signature")[3:])
+	if verifySignature(header, body+"3") {
+		t.Error("unknown signature version accepted")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type (
+	SlackClient interface {
+		postMessage(channel, threadTS, blocks, msg string) (ts string, err error)
+		postEphemeral(channel, threadTS, userID, msg string) error
+		updateMessage(channel, ts, blocks, msg string) error
+		upload(channel, threadTS, title, content string) error
+		openModal(triggerID, view string) error
+		getUserGroupMembers(groupID string) ([]string, error)
+	}
+	slackAPI struct {
+		token string
+	}
+	slackResponse struct {
+		OK      bool     `json:"ok"`
+		Error   string   `json:"error"`
+		Warning string   `json:"warning"`
+		TS      string   `json:"ts"`
+		Users   []string `json:"users"`
+	}
+	slackError struct {
+		method     string
+		code       string
+		statusCode int
+		retryAfter time.Duration
+	}
+)
+
+var slackClient SlackClient
+
+func (err *slackError) Error() string {
+	if err.code == "" {
+		return fmt.Sprintf("slack error [%s] response: %d", err.method, err.statusCode)
+	}
+	return fmt.Sprintf("slack error [%s] %s", err.method, err.code)
+}
+
+// Whether the same request stands a chance of succeeding later
+func (err *slackError) temporary() bool {
+	if err.statusCode == http.StatusTooManyRequests || err.statusCode >= 500 {
+		return true
+	}
+	switch err.code {
+	case "ratelimited", "internal_error", "fatal_error", "request_timeout", "service_unavailable":
+		return true
+	}
+	return false
+}
+
+func newSlackAPI(token string) *slackAPI {
+	return &slackAPI{token: token}
+}
+
+func (api *slackAPI) call(method string, params url.Values) (*slackResponse, error) {
+	params.Set("token", api.token)
+	resp, err := http.PostForm("https://slack.com/api/"+method, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slackErr := &slackError{method: method, statusCode: resp.StatusCode}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			slackErr.retryAfter = time.Duration(secs) * time.Second
+		}
+		return nil, slackErr
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := &slackResponse{}
+	if err := json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("slack error [%s] %s: %s", method, err.Error(), string(data))
+	}
+	if !res.OK {
+		return nil, &slackError{method: method, code: res.Error, statusCode: resp.StatusCode}
+	}
+	return res, nil
+}
+
+func (api *slackAPI) postMessage(channel, threadTS, blocks, msg string) (string, error) {
+	params := url.Values{}
+	params.Set("channel", channel)
+	if threadTS != "" {
+		params.Set("thread_ts", threadTS)
+	}
+	if blocks != "" {
+		params.Set("blocks", blocks)
+	}
+	if msg != "" {
+		params.Set("text", msg)
+	}
+	res, err := api.call("chat.postMessage", params)
+	if err != nil {
+		return "", err
+	}
+	return res.TS, nil
+}
+
+func (api *slackAPI) postEphemeral(channel, threadTS, userID, msg string) error {
+	params := url.Values{}
+	params.Set("channel", channel)
+	if threadTS != "" {
+		params.Set("thread_ts", threadTS)
+	}
+	params.Set("user", userID)
+	params.Set("text", msg)
+	_, err := api.call("chat.postEphemeral", params)
+	return err
+}
+
+func (api *slackAPI) updateMessage(channel, ts, blocks, msg string) error {
+	params := url.Values{}
+	params.Set("channel", channel)
+	params.Set("ts", ts)
+	if blocks != "" {
+		params.Set("blocks", blocks)
+	}
+	if msg != "" {
+		params.Set("text", msg)
+	}
+	_, err := api.call("chat.update", params)
+	return err
+}
+
+func (api *slackAPI) upload(channel, threadTS, title, content string) error {
+	params := url.Values{}
+	params.Set("channels", channel)
+	if threadTS != "" {
+		params.Set("thread_ts", threadTS)
+	}
+	params.Set("title", title)
+	params.Set("content", content)
+	_, err := api.call("files.upload", params)
+	return err
+}
+
+func (api *slackAPI) openModal(triggerID, view string) error {
+	params := url.Values{}
+	params.Set("trigger_id", triggerID)
+	params.Set("view", view)
+	_, err := api.call("views.open", params)
+	return err
+}
+
+func (api *slackAPI) getUserGroupMembers(groupID string) ([]string, error) {
+	params := url.Values{}
+	params.Set("usergroup", groupID)
+	res, err := api.call("usergroups.users.list", params)
+	if err != nil {
+		return nil, err
+	}
+	return res.Users, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+type (
+	fakeSlackCall struct {
+		method   string
+		channel  string
+		threadTS string
+		ts       string
+		userID   string
+		blocks   string
+		msg      string
+	}
+	// Records calls in memory instead of talking to Slack, for exercising report and interaction flows
+	fakeSlack struct {
+		sync.Mutex
+		calls  []fakeSlackCall
+		groups map[string][]string
+		err    error
+		seq    int
+	}
+)
+
+func (fake *fakeSlack) record(call fakeSlackCall) error {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.calls = append(fake.calls, call)
+	return fake.err
+}
+
+func (fake *fakeSlack) nextTS() string {
+	fake.Lock()
+	defer fake.Unlock()
+	fake.seq++
+	return fmt.Sprintf("1000000000.%06d", fake.seq)
+}
+
+// Returns a copy of every call made with the given method
+func (fake *fakeSlack) callsTo(method string) []fakeSlackCall {
+	fake.Lock()
+	defer fake.Unlock()
+	calls := make([]fakeSlackCall, 0)
+	for _, call := range fake.calls {
+		if call.method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (fake *fakeSlack) postMessage(channel, threadTS, blocks, msg string) (string, error) {
+	ts := fake.nextTS()
+	err := fake.record(fakeSlackCall{
+		method:   "chat.postMessage",
+		channel:  channel,
+		threadTS: threadTS,
+		ts:       ts,
+		blocks:   blocks,
+		msg:      msg,
+	})
+	if err != nil {
+		return "", err
+	}
+	return ts, nil
+}
+
+func (fake *fakeSlack) postEphemeral(channel, threadTS, userID, msg string) error {
+	return fake.record(fakeSlackCall{
+		method:   "chat.postEphemeral",
+		channel:  channel,
+		threadTS: threadTS,
+		userID:   userID,
+		msg:      msg,
+	})
+}
+
+func (fake *fakeSlack) updateMessage(channel, ts, blocks, msg string) error {
+	return fake.record(fakeSlackCall{
+		method:  "chat.update",
+		channel: channel,
+		ts:      ts,
+		blocks:  blocks,
+		msg:     msg,
+	})
+}
+
+func (fake *fakeSlack) upload(channel, threadTS, title, content string) error {
+	return fake.record(fakeSlackCall{
+		method:   "files.upload",
+		channel:  channel,
+		threadTS: threadTS,
+		msg:      title + "\n" + content,
+	})
+}
+
+func (fake *fakeSlack) openModal(triggerID, view string) error {
+	return fake.record(fakeSlackCall{
+		method: "views.open",
+		ts:     triggerID,
+		blocks: view,
+	})
+}
+
+func (fake *fakeSlack) getUserGroupMembers(groupID string) ([]string, error) {
+	if err := fake.record(fakeSlackCall{method: "usergroups.users.list", msg: groupID}); err != nil {
+		return nil, err
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	return fake.groups[groupID], nil
+}
+
+// Flows that touch the database run against the MySQL instance named by SIBYL_TEST_DATABASE, e.g.
+// root:root@(localhost:3306)/sibyl_test?charset=utf8mb4&parseTime=True&loc=Local
+func setupTest(t *testing.T) *fakeSlack {
+	uri := os.Getenv("SIBYL_TEST_DATABASE")
+	if uri == "" {
+		t.Skip("SIBYL_TEST_DATABASE not set")
+	}
+	var err error
+	if db, err = gorm.Open("mysql", uri); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	saveConfig(t)
+	config.CampusDomain = "42.us.org"
+	config.Slack.Channel = "CREPORTS"
+	config.Slack.MaxAttempts = 3
+	fake := &fakeSlack{groups: make(map[string][]string)}
+	slackClient = fake
+	intraWrites = dryRunIntraWriter{}
+	return fake
+}
+
+// Restores whatever the test changes in the global config once it's done
+func saveConfig(t *testing.T) {
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+	})
+}
+
+// Records a team Sibyl already knows about, so nothing has to be fetched from Intra
+func createTestTeam(t *testing.T, logins ...string) int {
+	teamID := int(time.Now().UnixNano() % 1000000000)
+	rec := &TeamRecord{TeamID: teamID}
+	for i, login := range logins {
+		rec.TeamRecordUsers = append(rec.TeamRecordUsers, TeamRecordUser{
+			UserID: teamID*10 + i,
+			Login:  login,
+		})
+	}
+	if err := db.Create(rec).Error; err != nil {
+		t.Fatal(err)
+	}
+	return teamID
+}
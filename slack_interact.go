@@ -8,6 +8,8 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type (
@@ -35,44 +37,115 @@ type (
 			ID   string `json:"id"`
 			Name string `json:"name"`
 		} `json:"channel"`
-		ResponseURL string `json:"response_url"`
-		Actions     []struct {
-			Type           string `json:"type"`
-			ActionID       string `json:"action_id"`
-			BlockID        string `json:"block_id"`
-			SelectedOption struct {
-				Text struct {
+		ResponseURL string              `json:"response_url"`
+		Actions     []InteractionAction `json:"actions"`
+		View        struct {
+			ID              string `json:"id"`
+			CallbackID      string `json:"callback_id"`
+			PrivateMetadata string `json:"private_metadata"`
+			State           struct {
+				Values map[string]map[string]struct {
 					Type  string `json:"type"`
-					Text  string `json:"text"`
-					Emoji bool   `json:"emoji"`
-				} `json:"text"`
-				Value string `json:"value"`
-			} `json:"selected_option"`
-			ActionTs string `json:"action_ts"`
-		} `json:"actions"`
-	}
-	interactQueue chan *Interaction
+					Value string `json:"value"`
+				} `json:"values"`
+			} `json:"state"`
+		} `json:"view"`
+		submission *moderationInput
+	}
+	InteractionAction struct {
+		Type           string `json:"type"`
+		ActionID       string `json:"action_id"`
+		BlockID        string `json:"block_id"`
+		SelectedOption struct {
+			Text struct {
+				Type  string `json:"type"`
+				Text  string `json:"text"`
+				Emoji bool   `json:"emoji"`
+			} `json:"text"`
+			Value string `json:"value"`
+		} `json:"selected_option"`
+		Value    string `json:"value"`
+		ActionTs string `json:"action_ts"`
+	}
+	interactQueue struct {
+		in      chan *Interaction
+		reports *reportQueue
+	}
+	// Moderation, lock expiry and reconciliation all read a team's record, act on Intra and write the
+	// record back, so only one of them may work on a team at a time
+	teamMutex struct {
+		sync.Mutex
+		teams map[int]*sync.Mutex
+	}
 )
 
+var teamLocks = &teamMutex{teams: make(map[int]*sync.Mutex)}
+
+// Blocks until nothing else is working on the team; the returned function lets the next one in
+func (tm *teamMutex) lock(teamID int) func() {
+	tm.Lock()
+	mutex, present := tm.teams[teamID]
+	if !present {
+		mutex = &sync.Mutex{}
+		tm.teams[teamID] = mutex
+	}
+	tm.Unlock()
+	mutex.Lock()
+	return mutex.Unlock
+}
+
 var errTeamUsersLocked = errors.New("team's users are already locked")
 var errTeamUsersUnlocked = errors.New("team's users are not currently locked")
+var errUserLocked = errors.New("user is already locked")
+var errUserUnlocked = errors.New("user is not currently locked")
+var errUserFlagged = errors.New("user is already flagged for cheating")
+var errUserNotFlagged = errors.New("user is not currently flagged for cheating")
+
+func lockUser(rec *TeamRecord, user *TeamRecordUser, reason string, duration time.Duration) error {
+	if user.CloseID != nil {
+		return errUserLocked
+	}
+	userClose := &intra.UserClose{}
+	userClose.User.ID = user.UserID
+	userClose.Closer.ID = user.UserID
+	userClose.Reason = reason
+	var expiresAt *time.Time
+	if duration > 0 {
+		expiry := time.Now().Add(duration)
+		expiresAt = &expiry
+	}
+	err := intraWrites.createClose(userClose)
+	if err == nil {
+		err = rec.addClose(userClose, expiresAt)
+	}
+	return err
+}
 
-func lockTeamUsers(rec *TeamRecord) error {
+func unlockUser(rec *TeamRecord, user *TeamRecordUser) error {
+	if user.CloseID == nil {
+		return errUserUnlocked
+	}
+	userClose := &intra.UserClose{ID: *user.CloseID}
+	userClose.User.ID = user.UserID
+	var err error
+	// Closes left over from dry-run mode never existed in Intra, so there's nothing to lift there
+	if !isDryRunCloseID(userClose.ID) {
+		err = intraWrites.unclose(userClose)
+	}
+	if err == nil {
+		err = rec.removeClose(userClose)
+	}
+	return err
+}
+
+func lockTeamUsers(rec *TeamRecord, reason string, duration time.Duration) error {
 	locked := 0
 	for _, user := range rec.Users {
 		if user.CloseID != nil {
 			continue
 		}
 		locked++
-		userClose := &intra.UserClose{}
-		userClose.User.ID = user.UserID
-		userClose.Closer.ID = user.UserID
-		userClose.Reason = config.Slack.InteractiveCloseReason
-		err := userClose.Create(context.Background(), false, intra.CloseKindOther)
-		if err == nil {
-			err = rec.addClose(userClose)
-		}
-		if err != nil {
+		if err := lockUser(rec, user, reason, duration); err != nil {
 			return err
 		}
 	}
@@ -89,14 +162,7 @@ func unlockTeamUsers(rec *TeamRecord) error {
 			continue
 		}
 		unlocked++
-		userClose := &intra.UserClose{ID: *user.CloseID}
-		err := userClose.Get(context.Background(), false)
-		if err == nil {
-			if err = userClose.Unclose(context.Background(), false); err == nil {
-				err = rec.removeClose(userClose)
-			}
-		}
-		if err != nil {
+		if err := unlockUser(rec, user); err != nil {
 			return err
 		}
 	}
@@ -106,8 +172,35 @@ func unlockTeamUsers(rec *TeamRecord) error {
 	return nil
 }
 
-func flagCheating(rec *TeamRecord) error {
-	for _, user := range rec.Users {
+// Erases a single user's experience for the project; the team's mark is left alone
+func flagUser(user *TeamRecordUser) error {
+	if user.Cheated {
+		return errUserFlagged
+	}
+	if err := eraseUserExperiences(user); err != nil {
+		return err
+	}
+	return user.setCheated(true)
+}
+
+func forgiveUser(user *TeamRecordUser) error {
+	// A snapshot without the flag means an earlier attempt to flag them failed partway
+	if !user.Cheated && !user.ExpSnapshot {
+		return errUserNotFlagged
+	}
+	if err := restoreUserExperiences(user); err != nil {
+		return err
+	}
+	return user.setCheated(false)
+}
+
+// Intra reports experiences that are already gone as nonexistent
+func isIntraNotFound(err error) bool {
+	return strings.Contains(err.Error(), "404") || strings.Contains(err.Error(), "exist")
+}
+
+func eraseUserExperiences(user *TeamRecordUser) error {
+	if !user.ExpSnapshot {
 		experiences := intra.Experiences{}
 		err := experiences.GetForProjectsUser(
 			context.Background(),
@@ -115,130 +208,374 @@ func flagCheating(rec *TeamRecord) error {
 			user.ProjectsUserID,
 			nil,
 		)
+		if err == nil {
+			err = user.snapshotExperiences(experiences)
+		}
 		if err != nil {
 			return err
 		}
-		for i := range experiences {
-			exp := &experiences[i]
-			if err = exp.Delete(context.Background()); err == nil {
-				err = user.addErasedExp(exp)
-			}
-			if err != nil {
+	}
+	for i := range user.ErasedExperiences {
+		erased := &user.ErasedExperiences[i]
+		if erased.Erased {
+			continue
+		}
+		exp := &intra.Experience{ID: erased.IntraID}
+		exp.Amount = erased.Amount
+		if err := intraWrites.deleteExperience(exp); err != nil && !isIntraNotFound(err) {
+			return err
+		}
+		if err := erased.setErased(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recreated experiences get new IDs, so a match on everything else is the best Intra can tell us
+func hasRestoredExperience(user *TeamRecordUser, erased *ErasedExperience) (bool, error) {
+	experiences := intra.Experiences{}
+	err := experiences.GetForProjectsUser(
+		context.Background(),
+		true,
+		user.ProjectsUserID,
+		nil,
+	)
+	if err != nil {
+		return false, err
+	}
+	for _, exp := range experiences {
+		if exp.SkillID == erased.SkillID &&
+			exp.ExperiancableID == erased.ExperiancableID &&
+			exp.ExperiancableType == erased.ExperiancableType &&
+			exp.Amount == erased.Amount &&
+			exp.CursusID == erased.CursusID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Each experience is marked before and after it is recreated, so a retry never hands out the same
+// experience twice
+func restoreErasedExp(user *TeamRecordUser, erased *ErasedExperience) error {
+	if erased.Restored {
+		return nil
+	}
+	if erased.Restoring {
+		// The last attempt may have failed after Intra created the experience
+		restored, err := hasRestoredExperience(user, erased)
+		if err != nil {
+			return err
+		}
+		if restored {
+			return erased.setRestored()
+		}
+	} else if err := erased.setRestoring(); err != nil {
+		return err
+	}
+	exp := &intra.Experience{
+		UserID:            user.UserID,
+		SkillID:           erased.SkillID,
+		ExperiancableID:   erased.ExperiancableID,
+		ExperiancableType: erased.ExperiancableType,
+		Amount:            erased.Amount,
+		CreatedAt:         erased.CreationTime,
+		CursusID:          erased.CursusID,
+	}
+	if err := intraWrites.createExperience(exp); err != nil {
+		return err
+	}
+	return erased.setRestored()
+}
+
+func restoreUserExperiences(user *TeamRecordUser) error {
+	pending := make([]ErasedExperience, len(user.ErasedExperiences))
+	copy(pending, user.ErasedExperiences)
+	for i := range pending {
+		erased := &pending[i]
+		// Experiences that were snapshotted but never deleted only need to be forgotten
+		if erased.Erased {
+			if err := restoreErasedExp(user, erased); err != nil {
 				return err
 			}
 		}
+		if err := user.removeErasedExp(erased); err != nil {
+			return err
+		}
 	}
-	team := &intra.Team{ID: rec.TeamID}
-	err := team.Get(context.Background(), false)
-	if err == nil {
-		params := url.Values{}
-		params.Set("team[final_mark]", "-42")
-		err = team.Patch(context.Background(), false, params)
+	return user.clearExpSnapshot()
+}
+
+func setTeamFinalMark(teamID, mark int) error {
+	params := url.Values{}
+	params.Set("team[final_mark]", strconv.Itoa(mark))
+	return intraWrites.patchTeam(teamID, params)
+}
+
+// Resumable: every experience erased is recorded as it goes, so calling this again after a failure
+// only finishes the remaining steps
+func flagCheating(rec *TeamRecord) error {
+	if rec.CheatingSaga != sagaFlagging {
+		if err := rec.setCheatingSaga(sagaFlagging); err != nil {
+			return err
+		}
 	}
-	return err
+	for _, user := range rec.Users {
+		err := eraseUserExperiences(user)
+		if err == nil {
+			err = user.setCheated(true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := setTeamFinalMark(rec.TeamID, -42); err != nil {
+		return err
+	}
+	return rec.finishCheatingSaga(true)
 }
 
+// Resumable: restores exactly the experiences erased by flagCheating, including a flag that never finished
 func forgiveCheating(rec *TeamRecord) error {
+	if rec.CheatingSaga != sagaForgiving {
+		if err := rec.setCheatingSaga(sagaForgiving); err != nil {
+			return err
+		}
+	}
 	for _, user := range rec.Users {
-		for _, erased := range user.ErasedExperiences {
-			exp := &intra.Experience{
-				UserID:            user.UserID,
-				SkillID:           erased.SkillID,
-				ExperiancableID:   erased.ExperiancableID,
-				ExperiancableType: erased.ExperiancableType,
-				Amount:            erased.Amount,
-				CreatedAt:         erased.CreationTime,
-				CursusID:          erased.CursusID,
-			}
-			err := exp.Create(context.Background(), false)
-			if err == nil {
-				err = user.removeErasedExp(exp)
-			}
-			if err != nil {
-				return err
-			}
+		err := restoreUserExperiences(user)
+		if err == nil {
+			err = user.setCheated(false)
+		}
+		if err != nil {
+			return err
 		}
 	}
-	team := &intra.Team{ID: rec.TeamID}
-	err := team.Get(context.Background(), false)
-	if err == nil {
-		params := url.Values{}
-		params.Set("team[final_mark]", strconv.Itoa(rec.OriginalScore))
-		err = team.Patch(context.Background(), false, params)
+	if err := setTeamFinalMark(rec.TeamID, rec.OriginalScore); err != nil {
+		return err
 	}
+	return rec.finishCheatingSaga(false)
+}
+
+func (si *Interaction) reply(msg string) error {
+	_, err := slackClient.postMessage(si.Container.ChannelID, si.Container.MessageTs, "", msg)
 	return err
 }
 
+func (si *Interaction) replyEphemeral(msg string) error {
+	return slackClient.postEphemeral(si.Container.ChannelID, si.Container.MessageTs, si.User.ID, msg)
+}
+
 func (si *Interaction) reportError(err error) error {
 	outputErr(err, false)
 	msg := "Something went wrong—please try again in a moment."
-	return getSlack().postEphemeralMessage(si.Container.MessageTs, si.User.ID, msg)
+	return si.replyEphemeral(msg)
+}
+
+func (si *Interaction) getCloseReason() string {
+	if si.submission != nil {
+		return si.submission.reason
+	}
+	return config.Slack.InteractiveCloseReason
+}
+
+func (si *Interaction) getLockDuration() time.Duration {
+	if si.submission != nil {
+		return si.submission.duration
+	}
+	return 0
+}
+
+// Stamps the action on the team's record, refreshes the report's status line and announces it in the thread
+func (si *Interaction) recordAction(rec *TeamRecord, action, msg string) error {
+	if si.submission != nil {
+		note := &TeamNote{
+			ActorID:  si.User.ID,
+			Action:   action,
+			Reason:   si.submission.reason,
+			Note:     si.submission.note,
+			Duration: si.submission.duration,
+		}
+		if err := rec.addNote(note); err != nil {
+			outputErr(err, false)
+		}
+	}
+	if err := rec.setLastAction(action, si.User.ID); err != nil {
+		outputErr(err, false)
+	} else if err := rec.updateReportMessage(); err != nil {
+		outputErr(err, false)
+	}
+	return si.reply(msg)
 }
 
 func (si *Interaction) process() error {
-	value := strings.Split(si.Actions[0].SelectedOption.Value, ":")
-	action := value[0]
-	teamID, _ := strconv.Atoi(value[1])
+	action, teamID, login := si.getAction()
+	defer teamLocks.lock(teamID)()
 	rec := &TeamRecord{}
 	if err := rec.get(teamID); err != nil {
 		return err
 	}
+	event := newAuditEvent(si, action, teamID)
+	if login != "" {
+		return si.processUserAction(rec, login, action, event)
+	}
 	switch action {
 	case "lock":
-		if err := lockTeamUsers(rec); err != nil {
+		before := snapshotCloses(rec)
+		err := lockTeamUsers(rec, si.getCloseReason(), si.getLockDuration())
+		event.setCloseChanges(before, rec)
+		if err != nil {
 			if err == errTeamUsersLocked {
+				event.finish(auditRejected, err)
 				msg := "This team's users have already been locked for academic integrity issues."
-				return getSlack().postEphemeralMessage(si.Container.MessageTs, si.User.ID, msg)
+				return si.replyEphemeral(msg)
 			}
+			event.finish(auditFailed, err)
 			return si.reportError(err)
 		}
+		event.finish(auditSucceeded, nil)
 		msg := fmt.Sprintf("<@%s> has locked this team's users.", si.User.ID)
-		return getSlack().postMessage(si.Container.MessageTs, "", msg)
+		return si.recordAction(rec, action, msg)
 	case "unlock":
-		if err := unlockTeamUsers(rec); err != nil {
+		before := snapshotCloses(rec)
+		err := unlockTeamUsers(rec)
+		event.setCloseChanges(before, rec)
+		if err != nil {
 			if err == errTeamUsersUnlocked {
+				event.finish(auditRejected, err)
 				msg := "This team's users are not currently locked for academic integrity issues."
-				return getSlack().postEphemeralMessage(si.Container.MessageTs, si.User.ID, msg)
+				return si.replyEphemeral(msg)
 			}
+			event.finish(auditFailed, err)
 			return si.reportError(err)
 		}
+		event.finish(auditSucceeded, nil)
 		msg := fmt.Sprintf("<@%s> has unlocked this team's users.", si.User.ID)
-		return getSlack().postMessage(si.Container.MessageTs, "", msg)
+		return si.recordAction(rec, action, msg)
 	case "flag_cheating":
+		event.setAffectedUsers(rec.getUsers())
 		if rec.Cheated == true {
+			event.finish(auditRejected, errors.New("team already flagged for cheating"))
 			msg := "This team has already been flagged for cheating."
-			return getSlack().postEphemeralMessage(si.Container.MessageTs, si.User.ID, msg)
+			return si.replyEphemeral(msg)
 		}
-		err := flagCheating(rec)
-		if err == nil {
-			err = rec.setCheated(true)
+		if rec.CheatingSaga == sagaForgiving {
+			event.finish(auditRejected, errors.New("forgiveness in progress"))
+			msg := "This team is partway through being forgiven—finish forgiving them before flagging again."
+			return si.replyEphemeral(msg)
 		}
-		if err != nil {
+		if err := flagCheating(rec); err != nil {
+			event.finish(auditFailed, err)
 			return si.reportError(err)
 		}
+		event.finish(auditSucceeded, nil)
 		msg := fmt.Sprintf("<@%s> has flagged this team for cheating.", si.User.ID)
-		return getSlack().postMessage(si.Container.MessageTs, "", msg)
+		return si.recordAction(rec, action, msg)
 	case "forgive_cheating":
-		if rec.Cheated == false {
+		event.setAffectedUsers(rec.getUsers())
+		// A flag that failed partway can still be forgiven to undo what it managed to erase
+		if rec.Cheated == false && rec.CheatingSaga == "" {
+			event.finish(auditRejected, errors.New("team not flagged for cheating"))
 			msg := "This team is not currently flagged for cheating."
-			return getSlack().postEphemeralMessage(si.Container.MessageTs, si.User.ID, msg)
+			return si.replyEphemeral(msg)
 		}
-		err := forgiveCheating(rec)
-		if err == nil {
-			err = rec.setCheated(false)
-		}
-		if err != nil {
+		if err := forgiveCheating(rec); err != nil {
+			event.finish(auditFailed, err)
 			return si.reportError(err)
 		}
+		event.finish(auditSucceeded, nil)
 		msg := fmt.Sprintf("<@%s> has cleared this team of cheating and restored their experience.", si.User.ID)
-		return getSlack().postMessage(si.Container.MessageTs, "", msg)
+		return si.recordAction(rec, action, msg)
 	}
 	return fmt.Errorf("unsupported action called: %s", action)
 }
 
-func (queue interactQueue) processInput() {
-	for si := range queue {
-		if err := si.process(); err != nil {
+var userActionRejections = map[error]string{
+	errUserLocked:     "%s has already been locked for academic integrity issues.",
+	errUserUnlocked:   "%s is not currently locked for academic integrity issues.",
+	errUserFlagged:    "%s has already been flagged for cheating.",
+	errUserNotFlagged: "%s is not currently flagged for cheating.",
+}
+
+var userActionMessages = map[string]string{
+	"lock_user":    "<@%s> has locked %s.",
+	"unlock_user":  "<@%s> has unlocked %s.",
+	"flag_user":    "<@%s> has flagged %s for cheating.",
+	"forgive_user": "<@%s> has cleared %s of cheating and restored their experience.",
+}
+
+func (si *Interaction) processUserAction(rec *TeamRecord, login, action string, event *AuditEvent) error {
+	user := rec.findUser(login)
+	if user == nil {
+		event.finish(auditRejected, fmt.Errorf("%s is not on team %d", login, rec.TeamID))
+		return si.replyEphemeral(fmt.Sprintf("%s is no longer on this team.", login))
+	}
+	event.setAffectedUsers([]*TeamRecordUser{user})
+	before := snapshotCloses(rec)
+	var err error
+	switch action {
+	case "lock_user":
+		err = lockUser(rec, user, si.getCloseReason(), si.getLockDuration())
+	case "unlock_user":
+		err = unlockUser(rec, user)
+	case "flag_user":
+		err = flagUser(user)
+	case "forgive_user":
+		err = forgiveUser(user)
+	default:
+		return fmt.Errorf("unsupported action called: %s", action)
+	}
+	if action == "lock_user" || action == "unlock_user" {
+		event.setCloseChanges(before, rec)
+	}
+	if err != nil {
+		if reason, ok := userActionRejections[err]; ok {
+			event.finish(auditRejected, err)
+			return si.replyEphemeral(fmt.Sprintf(reason, login))
+		}
+		event.finish(auditFailed, err)
+		return si.reportError(err)
+	}
+	event.finish(auditSucceeded, nil)
+	msg := fmt.Sprintf(userActionMessages[action], si.User.ID, login)
+	return si.recordAction(rec, action+":"+login, msg)
+}
+
+// Puts a dead-lettered report back in front of Batman, or back on its way to Slack
+func (si *Interaction) requeueReport(queue *reportQueue) error {
+	jobID, _ := strconv.Atoi(si.Actions[0].Value)
+	job := &ReportJob{}
+	if err := job.get(uint(jobID)); err != nil {
+		return si.reportError(err)
+	}
+	state := job.State
+	if err := queue.requeue(job); err != nil {
+		if err == errJobNotDead {
+			msg := "This report has already been requeued."
+			return si.replyEphemeral(msg)
+		}
+		return si.reportError(err)
+	}
+	msg := fmt.Sprintf("<@%s> has sent this report back to Batman.", si.User.ID)
+	if state == jobDeadSlack {
+		msg = fmt.Sprintf("<@%s> has requeued this report for posting.", si.User.ID)
+	}
+	return si.reply(msg)
+}
+
+func (queue *interactQueue) processInput() {
+	for si := range queue.in {
+		allowed, err := si.authorize()
+		if err == nil && allowed {
+			action, _, _ := si.getAction()
+			if action == "rerun_batman" || action == "repost_report" {
+				err = si.requeueReport(queue.reports)
+			} else {
+				err = si.process()
+			}
+		}
+		if err != nil {
 			outputErr(err, false)
 		}
 	}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestInteraction(value string) *Interaction {
+	si := &Interaction{}
+	si.User.ID = "UMODERATOR"
+	si.Container.ChannelID = "CREPORTS"
+	si.Container.MessageTs = "1000000000.000001"
+	action := InteractionAction{ActionID: "manage_user"}
+	action.SelectedOption.Value = value
+	si.Actions = []InteractionAction{action}
+	return si
+}
+
+func TestProcessLockUser(t *testing.T) {
+	fake := setupTest(t)
+	teamID := createTestTeam(t, "alice", "bob")
+	si := newTestInteraction(fmt.Sprintf("lock_user:%d:alice", teamID))
+	si.submission = &moderationInput{reason: "Copied libft", duration: time.Hour}
+	if err := si.process(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &TeamRecord{}
+	if err := rec.get(teamID); err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := rec.findUser("alice"), rec.findUser("bob")
+	if alice.CloseID == nil || !isDryRunCloseID(*alice.CloseID) || alice.LockExpiresAt == nil {
+		t.Errorf("alice wasn't locked with an expiry: %+v", alice)
+	}
+	if bob.CloseID != nil {
+		t.Errorf("bob was locked too")
+	}
+	replies := fake.callsTo("chat.postMessage")
+	if len(replies) != 1 || replies[0].threadTS != si.Container.MessageTs ||
+		!strings.Contains(replies[0].msg, "has locked alice") {
+		t.Fatalf("expected the lock to be announced in the report's thread, got %+v", replies)
+	}
+
+	// Locking again is refused privately rather than announced
+	if err := si.process(); err != nil {
+		t.Fatal(err)
+	}
+	rejections := fake.callsTo("chat.postEphemeral")
+	if len(rejections) != 1 || !strings.Contains(rejections[0].msg, "already been locked") {
+		t.Errorf("expected an ephemeral rejection, got %+v", rejections)
+	}
+	if len(fake.callsTo("chat.postMessage")) != 1 {
+		t.Errorf("rejected lock was announced")
+	}
+}
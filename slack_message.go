@@ -4,20 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
-	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 )
 
-type slack struct {
-	token   string
-	channel string
-}
-
 func getSlackTimestamp(timestamp time.Time) string {
 	if timestamp.IsZero() {
 		return "N/A"
@@ -48,11 +40,116 @@ func getUserBlockElements(report *teamReport) string {
 		if user.login == report.leader {
 			text = "*" + text + "*"
 		}
+		if user.priorOffenses > 0 {
+			text += fmt.Sprintf(" :warning: _%d prior_", user.priorOffenses)
+		}
 		elements[(2*i)+1] = fmt.Sprintf(`{"type":"mrkdwn","text":"%s"}`, text)
 	}
 	return "[" + strings.Join(elements, ",") + "]"
 }
 
+var userActionOptions = []struct {
+	action string
+	label  string
+}{
+	{"lock_user", ":lock: Lock %s"},
+	{"unlock_user", ":unlock: Unlock %s"},
+	{"flag_user", ":hammer: Flag %s as cheating"},
+	{"forgive_user", ":ok_hand: Forgive %s"},
+}
+
+// Option groups for the per-user menu, one group per team member
+func getUserActionGroups(report *teamReport) string {
+	type text struct {
+		Type  string `json:"type"`
+		Text  string `json:"text"`
+		Emoji bool   `json:"emoji,omitempty"`
+	}
+	type option struct {
+		Text  text   `json:"text"`
+		Value string `json:"value"`
+	}
+	type group struct {
+		Label   text     `json:"label"`
+		Options []option `json:"options"`
+	}
+	groups := make([]group, len(report.users))
+	for i, user := range report.users {
+		groups[i].Label = text{Type: "plain_text", Text: user.login}
+		for _, opt := range userActionOptions {
+			groups[i].Options = append(groups[i].Options, option{
+				Text:  text{Type: "plain_text", Text: fmt.Sprintf(opt.label, user.login), Emoji: true},
+				Value: fmt.Sprintf("%s:%d:%s", opt.action, report.teamID, user.login),
+			})
+		}
+	}
+	data, _ := json.Marshal(groups)
+	return string(data)
+}
+
+// Buckets of local commit hours, starting at midnight
+var commitPeriods = []string{"night", "morning", "afternoon", "evening"}
+
+// Summarizes the repo's history as section fields; empty when there's nothing to show
+func getForensicsFields(history *repoHistory) string {
+	if history == nil || len(history.commits) == 0 {
+		return ""
+	}
+	authors := make([]string, len(history.authors))
+	for i, author := range history.authors {
+		authors[i] = fmt.Sprintf("%s `%s` (%d)", author.name, author.email, author.commits)
+	}
+	periods := make([]string, len(commitPeriods))
+	for i, period := range commitPeriods {
+		count := 0
+		for _, n := range history.hours[i*6 : (i+1)*6] {
+			count += n
+		}
+		periods[i] = fmt.Sprintf("%s %d", period, count)
+	}
+	dumps := "none"
+	if len(history.dumps) > 0 {
+		largest := history.dumps[0]
+		for _, commit := range history.dumps {
+			if commit.insertions > largest.insertions {
+				largest = commit
+			}
+		}
+		dumps = fmt.Sprintf(
+			"%d _(largest +%d lines in `%.7s`)_",
+			len(history.dumps),
+			largest.insertions,
+			largest.hash,
+		)
+	}
+	late := "none"
+	if len(history.lateCommits) > 0 {
+		late = fmt.Sprintf(
+			"%d _(last %s)_",
+			len(history.lateCommits),
+			getSlackTimestamp(history.lastCommit.Local()),
+		)
+	}
+	fields := []string{
+		"*First commit:* " + getSlackTimestamp(history.firstCommit.Local()),
+		"*Authors:* " + strings.Join(authors, ", "),
+		"*Commit times:* " + strings.Join(periods, " · "),
+		"*Large commits:* " + dumps,
+		"*After closing:* " + late,
+	}
+	elements := make([]string, len(fields))
+	for i, field := range fields {
+		elements[i] = fmt.Sprintf(`{"type": "mrkdwn", "text": "%s"}`, escapeJSONString(field))
+	}
+	return "[" + strings.Join(elements, ",") + "]"
+}
+
+// Escapes a string for embedding between quotes in a JSON template
+func escapeJSONString(str string) string {
+	escaped, _ := json.Marshal(&str)
+	return string(escaped[1 : len(escaped)-1])
+}
+
 // Ugly function, but haven't yet come up with a better alternative
 func composeBlocks(report *teamReport) (blocks string, err error) {
 	var tmpl *template.Template
@@ -60,7 +157,6 @@ func composeBlocks(report *teamReport) (blocks string, err error) {
 	if err != nil {
 		return
 	}
-	groupName, _ := json.Marshal(&report.name)
 	grade := strconv.Itoa(report.finalMark)
 	if report.teamCancelled {
 		grade += " _(cancelled)_"
@@ -70,15 +166,19 @@ func composeBlocks(report *teamReport) (blocks string, err error) {
 		grade += " _(failed)_"
 	}
 	var lastUpdate string
+	commits := 0
+	if report.repo.history != nil {
+		commits = len(report.repo.history.commits)
+	}
 	if report.repo.url == batmanNotApplicable {
 		lastUpdate = batmanNotApplicable
-	} else if report.repo.lastUpdate.IsZero() {
+	} else if commits == 0 {
 		lastUpdate = "never _(0 commits)_"
 	} else {
 		lastUpdate = fmt.Sprintf(
 			"%s _(%d commits)_",
-			getSlackTimestamp(report.repo.lastUpdate.Local()),
-			report.repo.commits,
+			getSlackTimestamp(report.repo.history.lastCommit.Local()),
+			commits,
 		)
 	}
 	data := &bytes.Buffer{}
@@ -86,6 +186,7 @@ func composeBlocks(report *teamReport) (blocks string, err error) {
 		TeamID       int
 		GroupName    string
 		UserElements string
+		UserActions  string
 		ProjectSlug  string
 		Grade        string
 		CreatedAt    string
@@ -94,10 +195,12 @@ func composeBlocks(report *teamReport) (blocks string, err error) {
 		RepoURL      string
 		LastUpdate   string
 		Commits      int
+		Forensics    string
 	}{
 		TeamID:       report.teamID,
-		GroupName:    string(groupName[1 : len(groupName)-1]),
+		GroupName:    escapeJSONString(report.name),
 		UserElements: getUserBlockElements(report),
+		UserActions:  getUserActionGroups(report),
 		ProjectSlug:  report.projectSlug,
 		Grade:        grade,
 		CreatedAt:    getSlackTimestamp(report.createdAt.Local()),
@@ -105,7 +208,8 @@ func composeBlocks(report *teamReport) (blocks string, err error) {
 		CheckResult:  report.repo.status,
 		RepoURL:      report.repo.url,
 		LastUpdate:   lastUpdate,
-		Commits:      report.repo.commits,
+		Commits:      commits,
+		Forensics:    getForensicsFields(report.repo.history),
 	})
 	compacted := &bytes.Buffer{}
 	err = json.Compact(compacted, data.Bytes())
@@ -113,61 +217,140 @@ func composeBlocks(report *teamReport) (blocks string, err error) {
 	return
 }
 
-func (slack *slack) postEphemeralMessage(threadTS, userID, msg string) error {
-	params := url.Values{}
-	params.Set("token", slack.token)
-	params.Set("channel", slack.channel)
-	if threadTS != "" {
-		params.Set("thread_ts", threadTS)
-	}
-	params.Set("user", userID)
-	params.Set("text", msg)
-	resp, err := http.PostForm("https://slack.com/api/chat.postEphemeral", params)
+// Notices for reports that gave up on Batman or Slack, with a button to give them another go
+func composeDeadLetterBlocks(report *teamReport) (blocks string, err error) {
+	var tmpl *template.Template
+	file := "templates/batman_failed.json"
+	if report.job.State == jobDeadSlack {
+		file = "templates/slack_failed.json"
+	}
+	tmpl, err = template.ParseFiles(file)
 	if err != nil {
-		return err
+		return
 	}
-	_ = resp.Body.Close()
-	return nil
+	data := &bytes.Buffer{}
+	err = tmpl.Execute(data, struct {
+		JobID         uint
+		Attempts      int
+		SlackAttempts int
+		LastError     string
+		GroupName     string
+		ProjectSlug   string
+	}{
+		JobID:         report.job.ID,
+		Attempts:      report.job.BatmanAttempts,
+		SlackAttempts: report.job.SlackAttempts,
+		LastError:     escapeJSONString(report.job.LastError),
+		GroupName:     escapeJSONString(report.name),
+		ProjectSlug:   report.projectSlug,
+	})
+	if err != nil {
+		return
+	}
+	compacted := &bytes.Buffer{}
+	err = json.Compact(compacted, data.Bytes())
+	blocks = compacted.String()
+	return
+}
+
+var actionDescriptions = map[string]string{
+	"lock":             "locked users",
+	"unlock":           "unlocked users",
+	"flag_cheating":    "flagged for cheating",
+	"forgive_cheating": "forgave cheating",
+	"lock_user":        "locked",
+	"unlock_user":      "unlocked",
+	"flag_user":        "flagged",
+	"forgive_user":     "forgave",
 }
 
-func (slack *slack) postMessage(threadTS, blocks, msg string) error {
-	params := url.Values{}
-	params.Set("token", slack.token)
-	params.Set("channel", slack.channel)
-	if threadTS != "" {
-		params.Set("thread_ts", threadTS)
+func composeStatusBlock(rec *TeamRecord) (json.RawMessage, error) {
+	locked := make([]string, 0)
+	flagged := make([]string, 0)
+	for _, user := range rec.TeamRecordUsers {
+		login := user.Login
+		if login == "" {
+			login = strconv.Itoa(user.UserID)
+		}
+		if user.CloseID != nil && user.LockExpiresAt != nil {
+			locked = append(locked, fmt.Sprintf("%s (until %s)", login, getSlackTimestamp(user.LockExpiresAt.Local())))
+		} else if user.CloseID != nil {
+			locked = append(locked, login)
+		}
+		if user.Cheated {
+			flagged = append(flagged, login)
+		}
 	}
-	if blocks != "" {
-		params.Set("blocks", blocks)
+	status := make([]string, 0)
+	if len(locked) > 0 {
+		status = append(status, ":lock: *Locked:* "+strings.Join(locked, ", "))
+	} else {
+		status = append(status, ":unlock: *Locked:* nobody")
 	}
-	if msg != "" {
-		params.Set("text", msg)
+	if rec.Cheated {
+		status = append(status, ":hammer: *Flagged for cheating*")
+	} else if len(flagged) > 0 {
+		status = append(status, ":hammer: *Flagged:* "+strings.Join(flagged, ", "))
 	}
-	resp, err := http.PostForm("https://slack.com/api/chat.postMessage", params)
-	if err != nil {
-		return err
+	switch rec.CheatingSaga {
+	case sagaFlagging:
+		status = append(status, ":warning: *Flag incomplete*")
+	case sagaForgiving:
+		status = append(status, ":warning: *Forgiveness incomplete*")
 	}
-	_ = resp.Body.Close()
-	return nil
+	if rec.LastActionAt != nil {
+		// Per-user actions are stored as action:login
+		parts := strings.SplitN(rec.LastAction, ":", 2)
+		action, ok := actionDescriptions[parts[0]]
+		if !ok {
+			action = parts[0]
+		}
+		if len(parts) > 1 {
+			action += " " + parts[1]
+		}
+		// Actions Sibyl takes on its own, like expiring locks, have no actor
+		actor := "automatically"
+		if rec.LastActorID != "" {
+			actor = fmt.Sprintf("by <@%s>", rec.LastActorID)
+		}
+		status = append(status, fmt.Sprintf(
+			"_Last: %s %s %s_",
+			action,
+			actor,
+			getSlackTimestamp(rec.LastActionAt.Local()),
+		))
+	}
+	type element struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	return json.Marshal(struct {
+		Type     string    `json:"type"`
+		BlockID  string    `json:"block_id"`
+		Elements []element `json:"elements"`
+	}{
+		Type:     "context",
+		BlockID:  "status",
+		Elements: []element{{Type: "mrkdwn", Text: strings.Join(status, "  |  ")}},
+	})
 }
 
-func (slack *slack) uploadMatches(matches string) error {
-	params := url.Values{}
-	params.Set("token", slack.token)
-	params.Set("channels", slack.channel)
-	params.Set("title", "Matches")
-	params.Set("content", matches)
-	resp, err := http.PostForm("https://slack.com/api/files.upload", params)
+// Re-renders the team's original report with a status line reflecting its current state
+func (rec *TeamRecord) updateReportMessage() error {
+	if rec.SlackTS == "" || rec.ReportBlocks == "" {
+		return nil
+	}
+	blocks := make([]json.RawMessage, 0)
+	if err := json.Unmarshal([]byte(rec.ReportBlocks), &blocks); err != nil {
+		return err
+	}
+	status, err := composeStatusBlock(rec)
 	if err != nil {
 		return err
 	}
-	_ = resp.Body.Close()
-	return nil
-}
-
-func getSlack() *slack {
-	return &slack{
-		token:   os.Getenv("SLACK_TOKEN"),
-		channel: config.Slack.Channel,
+	data, err := json.Marshal(append(blocks, status))
+	if err != nil {
+		return err
 	}
+	return slackClient.updateMessage(rec.SlackChannel, rec.SlackTS, string(data), "")
 }
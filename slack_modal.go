@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type (
+	moderationInput struct {
+		reason   string
+		note     string
+		duration time.Duration
+	}
+	// Carried through the modal so the submission knows what was clicked and where
+	moderationMetadata struct {
+		Value     string `json:"value"`
+		ChannelID string `json:"channel_id"`
+		MessageTs string `json:"message_ts"`
+	}
+)
+
+var modalTitles = map[string]string{
+	"lock":      "Lock users",
+	"flag":      "Flag cheating",
+	"lock_user": "Lock user",
+	"flag_user": "Flag user",
+}
+
+// Lock and flag actions ask for a reason before anything is done
+func needsModerationInput(action string) bool {
+	switch action {
+	case "lock", "flag_cheating", "lock_user", "flag_user":
+		return true
+	}
+	return false
+}
+
+func isLockAction(action string) bool {
+	return action == "lock" || action == "lock_user"
+}
+
+// Accepts anything time.ParseDuration does, plus whole days (e.g. 7d)
+func parseLockDuration(raw string) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	var duration time.Duration
+	var err error
+	if strings.HasSuffix(raw, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(raw, "d"))
+		duration = time.Duration(days) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(raw)
+	}
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("%q isn't a duration—try something like 12h or 7d", raw)
+	}
+	return duration, nil
+}
+
+func composeModerationModal(si *Interaction) (view string, err error) {
+	var tmpl *template.Template
+	tmpl, err = template.ParseFiles("templates/moderation_modal.json")
+	if err != nil {
+		return
+	}
+	action, _, login := si.getAction()
+	metadata, _ := json.Marshal(&moderationMetadata{
+		Value:     si.Actions[0].SelectedOption.Value,
+		ChannelID: si.Container.ChannelID,
+		MessageTs: si.Container.MessageTs,
+	})
+	title := modalTitles[strings.TrimSuffix(action, "_cheating")]
+	summary := fmt.Sprintf("*%s* for this team.", title)
+	if login != "" {
+		summary = fmt.Sprintf("*%s* %s.", title, login)
+	}
+	data := &bytes.Buffer{}
+	err = tmpl.Execute(data, struct {
+		PrivateMetadata string
+		Title           string
+		Summary         string
+		Reason          string
+		Lock            bool
+	}{
+		PrivateMetadata: escapeJSONString(string(metadata)),
+		Title:           title,
+		Summary:         escapeJSONString(summary),
+		Reason:          escapeJSONString(config.Slack.InteractiveCloseReason),
+		Lock:            isLockAction(action),
+	})
+	if err != nil {
+		return
+	}
+	compacted := &bytes.Buffer{}
+	err = json.Compact(compacted, data.Bytes())
+	view = compacted.String()
+	return
+}
+
+// Must be called while handling the click itself: Slack expires the trigger ID after about 3 seconds
+func (si *Interaction) openModerationModal() error {
+	view, err := composeModerationModal(si)
+	if err == nil {
+		err = slackClient.openModal(si.TriggerID, view)
+	}
+	if err != nil {
+		return si.reportError(err)
+	}
+	return nil
+}
+
+func (si *Interaction) getSubmittedValue(blockID string) string {
+	return strings.TrimSpace(si.View.State.Values[blockID]["value"].Value)
+}
+
+// Turns a modal submission back into the action that opened it; validation errors are keyed by block ID
+func (si *Interaction) loadSubmission() map[string]string {
+	metadata := &moderationMetadata{}
+	if err := json.Unmarshal([]byte(si.View.PrivateMetadata), metadata); err != nil {
+		return map[string]string{"reason": "This form has expired—please start over."}
+	}
+	input := &moderationInput{
+		reason: si.getSubmittedValue("reason"),
+		note:   si.getSubmittedValue("note"),
+	}
+	if input.reason == "" {
+		return map[string]string{"reason": "A reason is required."}
+	}
+	duration, err := parseLockDuration(si.getSubmittedValue("duration"))
+	if err != nil {
+		return map[string]string{"duration": err.Error()}
+	}
+	input.duration = duration
+	action := InteractionAction{ActionID: "manage_report"}
+	action.SelectedOption.Value = metadata.Value
+	si.Actions = []InteractionAction{action}
+	si.Container.ChannelID = metadata.ChannelID
+	si.Container.MessageTs = metadata.MessageTs
+	si.submission = input
+	return nil
+}
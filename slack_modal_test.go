@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLockDuration(t *testing.T) {
+	tests := []struct {
+		raw      string
+		duration time.Duration
+		valid    bool
+	}{
+		{"", 0, true},
+		{"  ", 0, true},
+		{"12h", 12 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"7d", 7 * 24 * time.Hour, true},
+		{" 2d ", 2 * 24 * time.Hour, true},
+		{"0d", 0, false},
+		{"-1h", 0, false},
+		{"d", 0, false},
+		{"forever", 0, false},
+	}
+	for _, test := range tests {
+		duration, err := parseLockDuration(test.raw)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: unexpected error state: %v", test.raw, err)
+			continue
+		}
+		if duration != test.duration {
+			t.Errorf("%q: parsed as %s, expected %s", test.raw, duration, test.duration)
+		}
+	}
+}
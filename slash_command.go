@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Keeps responses well under Slack's 50 block limit
+const commandMaxTeams = 20
+
+const commandUsage = "Usage: `/sibyl team <id>`, `/sibyl user <login>` or `/sibyl project <slug>`"
+
+func describeReports(teamID int) (string, error) {
+	jobs, err := getJobsForTeam(teamID)
+	if err != nil || len(jobs) == 0 {
+		return "no reports", err
+	}
+	last := jobs[len(jobs)-1]
+	status := last.BatmanStatus
+	if status == "" {
+		status = "not checked yet"
+	}
+	return fmt.Sprintf(
+		"%d reports (last: %s, %s %s)",
+		len(jobs),
+		status,
+		strings.Replace(last.State, "_", " ", -1),
+		getSlackTimestamp(last.CreatedAt.Local()),
+	), nil
+}
+
+func describeTeam(teamID int) (string, error) {
+	reports, err := describeReports(teamID)
+	if err != nil {
+		return "", err
+	}
+	lines := []string{fmt.Sprintf("*Team %d* — %s", teamID, reports)}
+	rec, err := findTeamRecord(teamID)
+	if err != nil || rec == nil {
+		return strings.Join(lines, "\n"), err
+	}
+	if rec.Cheated {
+		lines = append(lines, ":hammer: Team flagged for cheating")
+	}
+	for _, user := range rec.TeamRecordUsers {
+		erased := 0
+		for _, exp := range user.ErasedExperiences {
+			if exp.Erased {
+				erased += exp.Amount
+			}
+		}
+		state := make([]string, 0)
+		if user.CloseID != nil {
+			state = append(state, ":lock: locked")
+		}
+		if user.Cheated {
+			state = append(state, ":hammer: flagged")
+		}
+		if erased > 0 {
+			state = append(state, fmt.Sprintf("%d XP erased", erased))
+		}
+		if len(state) == 0 {
+			state = append(state, "no action taken")
+		}
+		lines = append(lines, fmt.Sprintf("• %s: %s", user.Login, strings.Join(state, ", ")))
+	}
+	if rec.LastActionAt != nil {
+		actor := "Sibyl"
+		if rec.LastActorID != "" {
+			actor = fmt.Sprintf("<@%s>", rec.LastActorID)
+		}
+		lines = append(lines, fmt.Sprintf("_Last action by %s %s_", actor, getSlackTimestamp(rec.LastActionAt.Local())))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func runCommand(text string) (header string, teamIDs []int, err error) {
+	args := strings.Fields(text)
+	if len(args) != 2 {
+		return commandUsage, nil, nil
+	}
+	switch args[0] {
+	case "team":
+		teamID, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return commandUsage, nil, nil
+		}
+		return fmt.Sprintf("History for team %d", teamID), []int{teamID}, nil
+	case "user":
+		teamIDs, err = getTeamIDsForLogin(args[1])
+		return fmt.Sprintf("Teams Sibyl has on record for %s", args[1]), teamIDs, err
+	case "project":
+		teamIDs, err = getTeamIDsForProject(args[1], commandMaxTeams)
+		return fmt.Sprintf("Most recent teams reported for %s", args[1]), teamIDs, err
+	}
+	return commandUsage, nil, nil
+}
+
+func composeCommandResponse(header string, teamIDs []int) (map[string]interface{}, error) {
+	type text struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type block struct {
+		Type string `json:"type"`
+		Text *text  `json:"text,omitempty"`
+	}
+	blocks := []block{{Type: "section", Text: &text{Type: "mrkdwn", Text: "*" + header + "*"}}}
+	if len(teamIDs) > commandMaxTeams {
+		blocks[0].Text.Text += fmt.Sprintf(" _(showing %d of %d)_", commandMaxTeams, len(teamIDs))
+		teamIDs = teamIDs[:commandMaxTeams]
+	}
+	for _, teamID := range teamIDs {
+		desc, err := describeTeam(teamID)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block{Type: "divider"}, block{Type: "section", Text: &text{Type: "mrkdwn", Text: desc}})
+	}
+	if len(teamIDs) == 0 && header != commandUsage {
+		blocks = append(blocks, block{Type: "section", Text: &text{Type: "mrkdwn", Text: "Nothing on record."}})
+	}
+	return map[string]interface{}{
+		"response_type": "ephemeral",
+		"blocks":        blocks,
+	}, nil
+}
+
+func handleSlashCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !verifySignature(r.Header, string(body)) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var response map[string]interface{}
+	allowed, err := isAuthorized(r.Form.Get("user_id"), "query")
+	if err == nil && !allowed {
+		response = map[string]interface{}{
+			"response_type": "ephemeral",
+			"text":          "You aren't authorized to do that—ask an administrator if you need access.",
+		}
+	} else if err == nil {
+		var header string
+		var teamIDs []int
+		if header, teamIDs, err = runCommand(r.Form.Get("text")); err == nil {
+			response, err = composeCommandResponse(header, teamIDs)
+		}
+	}
+	if err != nil {
+		outputErr(err, false)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		outputErr(err, false)
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,27 +22,140 @@ type (
 	}
 )
 
-const gitTimeFormat = "Mon Jan 2 15:04:05 2006 -0700"
+type (
+	gitCommit struct {
+		hash       string
+		time       time.Time
+		author     string
+		email      string
+		files      int
+		insertions int
+		deletions  int
+	}
+	gitAuthor struct {
+		name    string
+		email   string
+		commits int
+	}
+	repoHistory struct {
+		commits     []gitCommit
+		firstCommit time.Time
+		lastCommit  time.Time
+		authors     []gitAuthor
+		// Commits per local hour of day
+		hours       [24]int
+		dumps       []gitCommit
+		lateCommits []gitCommit
+	}
+)
+
+// Fields are separated by unit separators and commits by record separators so author names can't break parsing
+const gitLogFormat = "%x1e%H%x1f%at%x1f%an%x1f%ae"
+
+var shortStatPattern = regexp.MustCompile(`(\d+) (file|insertion|deletion)`)
+
+func parseGitLog(out string) ([]gitCommit, error) {
+	commits := make([]gitCommit, 0)
+	for _, record := range strings.Split(out, "\x1e") {
+		lines := strings.Split(strings.TrimSpace(record), "\n")
+		fields := strings.Split(lines[0], "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		secs, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		commit := gitCommit{
+			hash:   fields[0],
+			time:   time.Unix(secs, 0),
+			author: fields[2],
+			email:  fields[3],
+		}
+		// Merge commits have no shortstat line
+		for _, line := range lines[1:] {
+			for _, match := range shortStatPattern.FindAllStringSubmatch(line, -1) {
+				n, _ := strconv.Atoi(match[1])
+				switch match[2] {
+				case "file":
+					commit.files = n
+				case "insertion":
+					commit.insertions = n
+				case "deletion":
+					commit.deletions = n
+				}
+			}
+		}
+		commits = append(commits, commit)
+	}
+	return commits, nil
+}
 
-func (repo gitRepo) countCommits() (commits int, err error) {
-	var out []byte
-	cmd := fmt.Sprintf("git -C %s log | grep '^commit' | wc -l", repo.path)
-	out, err = repo.conn.runCommand(cmd)
-	if err != nil || len(out) == 0 {
-		return
-	}
-	return strconv.Atoi(strings.TrimRight(string(out), "\n"))
+// Commits are returned newest first; an empty repo yields no commits rather than an error
+func (repo gitRepo) getCommits() ([]gitCommit, error) {
+	// rev-parse only exits with 1 when HEAD doesn't exist yet; a missing or misresolved path is fatal
+	cmd := fmt.Sprintf("git -C %s rev-parse --verify --quiet HEAD", repo.path)
+	if _, err := repo.conn.runCommand(cmd); err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok && exitErr.ExitStatus() == 1 {
+			return []gitCommit{}, nil
+		}
+		return nil, fmt.Errorf("unable to inspect %s: %s", repo.path, err.Error())
+	}
+	cmd = fmt.Sprintf("git -C %s log --format='%s' --shortstat", repo.path, gitLogFormat)
+	out, err := repo.conn.runCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read history of %s: %s", repo.path, err.Error())
+	}
+	return parseGitLog(string(out))
+}
+
+// Commits landing after the deadline are collected unless the deadline is zero
+func (repo gitRepo) inspect(deadline time.Time) (*repoHistory, error) {
+	commits, err := repo.getCommits()
+	if err != nil {
+		return nil, err
+	}
+	return summarizeCommits(commits, deadline), nil
 }
 
-func (repo gitRepo) getLastUpdate() (lastUpdate time.Time, err error) {
-	var out []byte
-	cmd := fmt.Sprintf("git -C %s log | grep '^Date:' | head -n1", repo.path)
-	out, err = repo.conn.runCommand(cmd)
-	if err != nil || len(out) == 0 {
-		return
-	}
-	dateStr := strings.Trim(strings.SplitN(string(out), ":", 2)[1], " \n")
-	return time.Parse(gitTimeFormat, dateStr)
+func summarizeCommits(commits []gitCommit, deadline time.Time) *repoHistory {
+	history := &repoHistory{
+		commits:     commits,
+		authors:     make([]gitAuthor, 0),
+		dumps:       make([]gitCommit, 0),
+		lateCommits: make([]gitCommit, 0),
+	}
+	authorIndex := make(map[string]int)
+	for _, commit := range commits {
+		if history.firstCommit.IsZero() || commit.time.Before(history.firstCommit) {
+			history.firstCommit = commit.time
+		}
+		if commit.time.After(history.lastCommit) {
+			history.lastCommit = commit.time
+		}
+		key := strings.ToLower(commit.email)
+		if i, present := authorIndex[key]; present {
+			history.authors[i].commits++
+		} else {
+			authorIndex[key] = len(history.authors)
+			history.authors = append(history.authors, gitAuthor{
+				name:    commit.author,
+				email:   commit.email,
+				commits: 1,
+			})
+		}
+		history.hours[commit.time.Local().Hour()]++
+		if config.Vogsphere.DumpInsertions > 0 && commit.insertions >= config.Vogsphere.DumpInsertions {
+			history.dumps = append(history.dumps, commit)
+		}
+		if !deadline.IsZero() && commit.time.After(deadline) {
+			history.lateCommits = append(history.lateCommits, commit)
+		}
+	}
+	sort.SliceStable(history.authors, func(i, j int) bool {
+		return history.authors[i].commits > history.authors[j].commits
+	})
+	return history
 }
 
 func (vog vogConn) getGitRepo(repoURL, repoUUID string) gitRepo {
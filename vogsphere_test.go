@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const testGitLog = "\x1eaaaaaaaaaaaa\x1f1700000000\x1fAlice \"al\"\x1falice@student.42.us.org\n\n" +
+	" 12 files changed, 640 insertions(+), 3 deletions(-)\n" +
+	"\x1ebbbbbbbbbbbb\x1f1690000000\x1fBob\x1fbob@student.42.us.org\n" +
+	"\x1ecccccccccccc\x1f1680000000\x1falice\x1fALICE@student.42.us.org\n\n" +
+	" 1 file changed, 1 insertion(+)\n"
+
+func TestParseGitLog(t *testing.T) {
+	commits, err := parseGitLog(testGitLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 3 {
+		t.Fatalf("expected 3 commits, got %d", len(commits))
+	}
+	first := commits[0]
+	if first.hash != "aaaaaaaaaaaa" || first.author != "Alice \"al\"" || first.email != "alice@student.42.us.org" {
+		t.Errorf("header parsed wrong: %+v", first)
+	}
+	if first.files != 12 || first.insertions != 640 || first.deletions != 3 {
+		t.Errorf("shortstat parsed wrong: %+v", first)
+	}
+	if !first.time.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("time parsed wrong: %s", first.time)
+	}
+	// Merge commits come without a shortstat
+	if commits[1].files != 0 || commits[1].insertions != 0 {
+		t.Errorf("commit without shortstat picked up stats: %+v", commits[1])
+	}
+	if commits[2].files != 1 || commits[2].insertions != 1 || commits[2].deletions != 0 {
+		t.Errorf("singular shortstat parsed wrong: %+v", commits[2])
+	}
+	if commits, err := parseGitLog(""); err != nil || len(commits) != 0 {
+		t.Errorf("empty log gave %v, %v", commits, err)
+	}
+	if _, err := parseGitLog("\x1eabc\x1fnot a time\x1fA\x1fa@b"); err == nil {
+		t.Errorf("bad timestamp wasn't reported")
+	}
+}
+
+func TestSummarizeCommits(t *testing.T) {
+	saveConfig(t)
+	config.Vogsphere.DumpInsertions = 500
+	commits, err := parseGitLog(testGitLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Unix(1695000000, 0)
+	history := summarizeCommits(commits, deadline)
+	if !history.firstCommit.Equal(time.Unix(1680000000, 0)) || !history.lastCommit.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("wrong range: %s - %s", history.firstCommit, history.lastCommit)
+	}
+	// Emails are compared case-insensitively, so both of Alice's commits count towards her
+	if len(history.authors) != 2 || history.authors[0].email != "alice@student.42.us.org" ||
+		history.authors[0].commits != 2 || history.authors[1].commits != 1 {
+		t.Errorf("wrong authors: %+v", history.authors)
+	}
+	hours := 0
+	for _, n := range history.hours {
+		hours += n
+	}
+	if hours != 3 {
+		t.Errorf("expected 3 commits across the hours, got %d", hours)
+	}
+	if len(history.dumps) != 1 || history.dumps[0].hash != "aaaaaaaaaaaa" {
+		t.Errorf("wrong dumps: %+v", history.dumps)
+	}
+	if len(history.lateCommits) != 1 || history.lateCommits[0].hash != "aaaaaaaaaaaa" {
+		t.Errorf("wrong late commits: %+v", history.lateCommits)
+	}
+	if late := summarizeCommits(commits, time.Time{}).lateCommits; len(late) != 0 {
+		t.Errorf("commits counted as late without a deadline: %+v", late)
+	}
+}